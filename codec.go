@@ -0,0 +1,242 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Codec is the compression algorithm used to store a file in the vault.
+// The codec is recorded per file, so a vault may contain files stored
+// with different codecs. The generated code only contains the decompressors
+// of the codecs actually used.
+type Codec uint8
+
+const (
+	// StoredCodec stores files without compression.
+	StoredCodec Codec = iota
+	// ZlibCodec compresses files with compress/zlib (default).
+	ZlibCodec
+	// DeflateCodec compresses files with compress/flate (raw deflate).
+	DeflateCodec
+	// GzipCodec compresses files with compress/gzip.
+	GzipCodec
+	// LZWCodec compresses files with compress/lzw (LSB order, 8 bit literals).
+	// The compression level is ignored.
+	LZWCodec
+)
+
+var codecNames = [...]string{"stored", "zlib", "deflate", "gzip", "lzw"}
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	if int(c) < len(codecNames) {
+		return codecNames[c]
+	}
+	return fmt.Sprintf("Codec(%d)", c)
+}
+
+// ParseCodec returns the codec with the given name.
+func ParseCodec(name string) (Codec, error) {
+	for i, n := range codecNames {
+		if strings.EqualFold(n, name) {
+			return Codec(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec '%v': valid codecs are %v", name, strings.Join(codecNames[:], ", "))
+}
+
+// valid returns an error if the codec is unknown or does not support the compression level.
+func (c Codec) valid(level int) error {
+	switch c {
+	case StoredCodec, LZWCodec:
+		return nil
+	case ZlibCodec, DeflateCodec, GzipCodec:
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return fmt.Errorf("invalid compression level %v for codec '%v'", level, c)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown codec %v", c)
+}
+
+// newWriter returns a writer compressing all data written to w.
+func (c Codec) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case StoredCodec:
+		return nopWriteCloser{w}, nil
+	case ZlibCodec:
+		return zlib.NewWriterLevel(w, level)
+	case DeflateCodec:
+		return flate.NewWriter(w, level)
+	case GzipCodec:
+		return gzip.NewWriterLevel(w, level)
+	case LZWCodec:
+		return lzw.NewWriter(w, lzw.LSB, 8), nil
+	}
+	return nil, fmt.Errorf("unknown codec %v", c)
+}
+
+// blockWriter compresses the data in independent blocks of size uncompressed bytes,
+// so a reader can start decompressing at the beginning of any block. The end offsets
+// of the compressed blocks are recorded, no index is recorded if the data fits into one block.
+type blockWriter struct {
+	codec Codec
+	level int
+	size  int64
+	out   io.Writer
+	// n counts the compressed bytes written
+	n      countWriter
+	zw     io.WriteCloser
+	used   int64
+	blocks []int64
+}
+
+// newBlockWriter returns a writer compressing the data written to w in blocks,
+// a size of zero compresses all data as one block.
+func newBlockWriter(w io.Writer, codec Codec, level int, size int64) *blockWriter {
+	b := &blockWriter{codec: codec, level: level, size: size}
+	b.out = io.MultiWriter(w, &b.n)
+	return b
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if b.zw == nil {
+			if err := b.openBlock(); err != nil {
+				return written, err
+			}
+		}
+
+		n := len(p)
+		if b.size > 0 && int64(n) > b.size-b.used {
+			n = int(b.size - b.used)
+		}
+
+		if _, err := b.zw.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b.used += int64(n)
+		p = p[n:]
+
+		if b.size > 0 && b.used == b.size {
+			if err := b.closeBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *blockWriter) openBlock() error {
+	zw, err := b.codec.newWriter(b.out, b.level)
+	if err != nil {
+		return fmt.Errorf("failed to create %v writer: %w", b.codec, err)
+	}
+	b.zw, b.used = zw, 0
+	return nil
+}
+
+func (b *blockWriter) closeBlock() error {
+	err := b.zw.Close()
+	b.zw = nil
+	b.blocks = append(b.blocks, b.n.n)
+	return err
+}
+
+// Close terminates the last block, empty data is written as one empty block.
+func (b *blockWriter) Close() error {
+	if b.zw == nil && len(b.blocks) == 0 {
+		if err := b.openBlock(); err != nil {
+			return err
+		}
+	}
+
+	if b.zw != nil {
+		if err := b.closeBlock(); err != nil {
+			return err
+		}
+	}
+
+	if len(b.blocks) == 1 {
+		b.blocks = nil
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// codecRule assigns a codec to all files matching one of the patterns.
+type codecRule struct {
+	codec Codec
+	pats  patterns
+	m     matcher
+}
+
+// codecFor returns the codec used for the file with the given vault path.
+// auto is set if the codec was not chosen explicitly for the file,
+// in that case the generator may decide to store the file uncompressed.
+func (cfg GeneratorConfig) codecFor(vaultPath string) (codec Codec, auto bool) {
+	if !cfg.compress {
+		return StoredCodec, false
+	}
+
+	for _, r := range cfg.codecRules {
+		if r.m.matches(vaultPath) {
+			return r.codec, false
+		}
+	}
+	return cfg.codec, true
+}
+
+// compressedExts contains extensions of file formats which are already compressed.
+var compressedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true, ".heic": true,
+	".woff": true, ".woff2": true,
+	".zip": true, ".jar": true, ".war": true, ".apk": true, ".gz": true, ".tgz": true, ".bz2": true,
+	".xz": true, ".zst": true, ".br": true, ".7z": true, ".rar": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".odp": true, ".epub": true,
+	".mp3": true, ".mp4": true, ".m4a": true, ".m4v": true, ".aac": true, ".ogg": true, ".oga": true,
+	".ogv": true, ".opus": true, ".flac": true, ".webm": true, ".mkv": true, ".mov": true,
+}
+
+// compressedTypes contains content types reported by http.DetectContentType
+// of file formats which are already compressed.
+var compressedTypes = map[string]bool{
+	"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true,
+	"font/woff": true, "font/woff2": true,
+	"application/zip": true, "application/x-gzip": true, "application/x-rar-compressed": true,
+	"audio/mpeg": true, "audio/aac": true, "application/ogg": true, "video/mp4": true, "video/webm": true,
+}
+
+// isCompressedFormat reports whether the file has a known compressed format.
+func isCompressedFormat(name string, content []byte) bool {
+	if compressedExts[strings.ToLower(path.Ext(name))] {
+		return true
+	}
+
+	ct := http.DetectContentType(content)
+	if idx := strings.Index(ct, ";"); idx >= 0 {
+		ct = ct[:idx]
+	}
+	return compressedTypes[ct]
+}
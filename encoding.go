@@ -0,0 +1,407 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encoding defines how the data of the vault is written into the release file.
+type Encoding uint8
+
+const (
+	// EscapedEncoding writes the data as interpreted string literal,
+	// all non-printable bytes are escaped as \xNN (default).
+	EscapedEncoding Encoding = iota
+	// RawEncoding writes the data of files, which are valid UTF-8 and contain no NUL,
+	// carriage return, byte order mark or backtick, as raw string literals and the data
+	// of all other files as interpreted string literals. The literals are concatenated.
+	RawEncoding
+	// Base64Encoding writes the data as base64 encoded string constant,
+	// which is decoded once at program initialization.
+	Base64Encoding
+	// AssemblyEncoding writes the data with DATA directives into an assembly file next to
+	// the release file, so the compiler never parses the data as Go literal. The directives
+	// are independent of the architecture, the file builds on all architectures supported
+	// by the Go assembler.
+	AssemblyEncoding
+)
+
+var encodingNames = [...]string{"escaped", "raw", "base64", "asm"}
+
+// String returns the name of the encoding.
+func (e Encoding) String() string {
+	if int(e) < len(encodingNames) {
+		return encodingNames[e]
+	}
+	return fmt.Sprintf("Encoding(%d)", e)
+}
+
+// ParseEncoding returns the encoding with the given name.
+func ParseEncoding(name string) (Encoding, error) {
+	for i, n := range encodingNames {
+		if strings.EqualFold(n, name) {
+			return Encoding(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encoding '%v': valid encodings are %v", name, strings.Join(encodingNames[:], ", "))
+}
+
+// dataEncoder writes the data of the vault as Go source.
+type dataEncoder interface {
+	// write writes the data of the next file.
+	write(p []byte) error
+	// close terminates the declaration of the data.
+	close() error
+	// maxSize returns an upper bound of the bytes written to the data file
+	// by writing n more bytes and closing the encoder.
+	maxSize(n int) int64
+}
+
+// newDataEncoder starts the declaration of the variable vaultAssetBin<assetName> in w,
+// the AssemblyEncoding writes the data into asm.
+func newDataEncoder(enc Encoding, w, asm io.Writer, assetName string) (dataEncoder, error) {
+	switch enc {
+	case EscapedEncoding:
+		return &escapedEncoder{w: w}, fprintf(w, "\nvar vaultAssetBin%v = \"", assetName)
+	case RawEncoding:
+		return &rawEncoder{w: w}, fprintf(w, "\nvar vaultAssetBin%v = ", assetName)
+	case Base64Encoding:
+		e := &base64Encoder{w: w, assetName: assetName, enc: base64.NewEncoder(base64.StdEncoding, w)}
+		return e, fprintf(w, "\nvar vaultAssetBin%v string\n\nconst vaultAssetBin64%v = \"", assetName, assetName)
+	case AssemblyEncoding:
+		return &asmEncoder{w: w, asm: asm, assetName: assetName}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %v", enc)
+}
+
+type escapedEncoder struct {
+	w io.Writer
+}
+
+func (e *escapedEncoder) write(p []byte) error {
+	_, err := e.w.Write(escape(p))
+	return err
+}
+
+func (e *escapedEncoder) close() error {
+	return fprintf(e.w, "\"\n")
+}
+
+func (e *escapedEncoder) maxSize(n int) int64 {
+	return int64(4*n + 2)
+}
+
+// escape returns p as content of an interpreted string literal.
+func escape(p []byte) []byte {
+	var buf bytes.Buffer
+	for _, b := range p {
+		switch {
+		case b == '\n':
+			buf.WriteString(`\n`)
+		case b == '\\':
+			buf.WriteString(`\\`)
+		case b == '"':
+			buf.WriteString(`\"`)
+		case b == '\t':
+			fallthrough
+		case (b >= 32 && b <= 126):
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "\\x%02x", b)
+		}
+	}
+	return buf.Bytes()
+}
+
+// rawEncoder concatenates raw and interpreted string literals,
+// consecutive files with the same kind share one literal.
+type rawEncoder struct {
+	w io.Writer
+	// quote is the delimiter of the open literal, zero if no literal is open
+	quote byte
+}
+
+func (e *rawEncoder) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	quote, data := byte('"'), p
+	if rawAllowed(p) {
+		quote = '`'
+	} else {
+		data = escape(p)
+	}
+
+	if quote != e.quote {
+		if e.quote != 0 {
+			if err := fprintf(e.w, "%c +\n\t", e.quote); err != nil {
+				return err
+			}
+		}
+
+		if err := fprintf(e.w, "%c", quote); err != nil {
+			return err
+		}
+		e.quote = quote
+	}
+
+	_, err := e.w.Write(data)
+	return err
+}
+
+func (e *rawEncoder) close() error {
+	if e.quote == 0 {
+		return fprintf(e.w, "\"\"\n")
+	}
+	return fprintf(e.w, "%c\n", e.quote)
+}
+
+// maxSize includes the concatenation of a new literal.
+func (e *rawEncoder) maxSize(n int) int64 {
+	return int64(4*n + 8)
+}
+
+// rawAllowed reports whether p can be written as raw string literal without changing its value.
+func rawAllowed(p []byte) bool {
+	return utf8.Valid(p) && bytes.IndexAny(p, "\x00\r`\ufeff") == -1
+}
+
+type base64Encoder struct {
+	w         io.Writer
+	assetName string
+	enc       io.WriteCloser
+}
+
+func (e *base64Encoder) write(p []byte) error {
+	_, err := e.enc.Write(p)
+	return err
+}
+
+func (e *base64Encoder) close() error {
+	if err := e.enc.Close(); err != nil {
+		return err
+	}
+	return fprintf(e.w, base64Trailer, e.assetName)
+}
+
+// maxSize includes the bytes buffered by the base64 encoder.
+func (e *base64Encoder) maxSize(n int) int64 {
+	return int64(4*((n+2)/3+1) + len(fmt.Sprintf(base64Trailer, e.assetName)))
+}
+
+// base64Trailer terminates the base64 constant and decodes it.
+const base64Trailer = `"
+
+func init() {
+	data, err := base64.StdEncoding.DecodeString(vaultAssetBin64%[1]v)
+	if err != nil {
+		panic(err)
+	}
+	vaultAssetBin%[1]v = string(data)
+}
+`
+
+// countWriter counts the bytes written.
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// asmHeader is written at the beginning of the assembly file after the build constraint.
+const asmHeader = `// This file is generated by the vault-cli command line utility.
+// It contains the data of the vault declared in the release file.
+// DO NOT EDIT this file, it will be overwritten on the next run of the vault-cli utility.
+
+#include "textflag.h"
+
+`
+
+// Directives of the assembly file.
+const (
+	asmData  = "DATA \u00b7vaultAssetBinData%v+%v(SB)/%v, $\"%s\"\n"
+	asmGlobl = "GLOBL \u00b7vaultAssetBinData%v(SB), RODATA|NOPTR, $%v\n"
+)
+
+// asmEncoder writes the data as DATA directives of at most 8 bytes,
+// the release file declares an array of the same size and a string referencing it.
+type asmEncoder struct {
+	w, asm    io.Writer
+	assetName string
+	// pending contains the bytes not yet written, less than 8
+	pending []byte
+	offset  int64
+}
+
+func (e *asmEncoder) write(p []byte) error {
+	var buf bytes.Buffer
+	if len(e.pending) > 0 {
+		n := 8 - len(e.pending)
+		if n > len(p) {
+			n = len(p)
+		}
+		e.pending = append(e.pending, p[:n]...)
+		p = p[n:]
+
+		if len(e.pending) < 8 {
+			return nil
+		}
+		e.data(&buf, e.pending)
+		e.pending = e.pending[:0]
+	}
+
+	for ; len(p) >= 8; p = p[8:] {
+		e.data(&buf, p[:8])
+	}
+	e.pending = append(e.pending, p...)
+
+	_, err := e.asm.Write(buf.Bytes())
+	return err
+}
+
+// data writes a DATA directive for p at the current offset.
+func (e *asmEncoder) data(buf *bytes.Buffer, p []byte) {
+	fmt.Fprintf(buf, asmData, e.assetName, e.offset, len(p), escape(p))
+	e.offset += int64(len(p))
+}
+
+func (e *asmEncoder) close() error {
+	if len(e.pending) > 0 {
+		var buf bytes.Buffer
+		e.data(&buf, e.pending)
+		if _, err := e.asm.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	// An empty symbol can not be declared in assembly
+	if e.offset == 0 {
+		return fprintf(e.w, "\nvar vaultAssetBin%v = \"\"\n", e.assetName)
+	}
+
+	err := fprintf(e.asm, asmGlobl, e.assetName, e.offset)
+	if err != nil {
+		return err
+	}
+
+	return fprintf(e.w, asmDecl, e.assetName, e.offset)
+}
+
+// asmDecl declares the data defined in the assembly file,
+// the string references the data without copying it.
+const asmDecl = `
+// vaultAssetBinData%[1]v is defined in the assembly file.
+var vaultAssetBinData%[1]v [%[2]v]byte
+
+var vaultAssetBin%[1]v = *(*string)(unsafe.Pointer(&struct {
+	data unsafe.Pointer
+	len  int
+}{unsafe.Pointer(&vaultAssetBinData%[1]v), len(vaultAssetBinData%[1]v)}))
+`
+
+// maxSize only counts the assembly file, a DATA directive contains at most 8 bytes.
+func (e *asmEncoder) maxSize(n int) int64 {
+	end := e.offset + int64(len(e.pending)+n)
+	line := len(fmt.Sprintf(asmData, e.assetName, end, 8, strings.Repeat(`\x00`, 8)))
+	return int64(((len(e.pending)+n)/8+1)*line + len(fmt.Sprintf(asmGlobl, e.assetName, end)))
+}
+
+// escapedLen contains the length of every byte in an interpreted string literal written by escape.
+var escapedLen [256]int64
+
+func init() {
+	for b := range escapedLen {
+		escapedLen[b] = int64(len(escape([]byte{byte(b)})))
+	}
+}
+
+// sizeCounter computes the size of the data declaration for every encoding from
+// byte counts, so only the encoding of the vault has to encode the data.
+type sizeCounter struct {
+	assetName string
+	// n counts the bytes of the data, escaped their length in an interpreted string literal
+	n, escaped int64
+	// raw counts the bytes the rawEncoder writes, quote is the delimiter of its open literal
+	raw   int64
+	quote byte
+}
+
+// write counts the data of the next file like the encoders write it.
+func (c *sizeCounter) write(p []byte) {
+	var escaped int64
+	for _, b := range p {
+		escaped += escapedLen[b]
+	}
+	c.n += int64(len(p))
+	c.escaped += escaped
+
+	if len(p) == 0 {
+		return
+	}
+
+	quote, size := byte('"'), escaped
+	if rawAllowed(p) {
+		quote, size = '`', int64(len(p))
+	}
+
+	if quote != c.quote {
+		if c.quote != 0 {
+			// Closing delimiter and " +\n\t"
+			c.raw += 5
+		}
+		c.raw++
+		c.quote = quote
+	}
+	c.raw += size
+}
+
+// size returns the size of the data declaration written by the encoding,
+// the size of the AssemblyEncoding includes the assembly file.
+func (c *sizeCounter) size(enc Encoding) int64 {
+	a := c.assetName
+	switch enc {
+	case EscapedEncoding:
+		return int64(len(fmt.Sprintf("\nvar vaultAssetBin%v = \"", a))) + c.escaped + 2
+	case RawEncoding:
+		end := int64(2)
+		if c.quote == 0 {
+			end = 3
+		}
+		return int64(len(fmt.Sprintf("\nvar vaultAssetBin%v = ", a))) + c.raw + end
+	case Base64Encoding:
+		return int64(len(fmt.Sprintf("\nvar vaultAssetBin%v string\n\nconst vaultAssetBin64%v = \"", a, a))) +
+			4*((c.n+2)/3) + int64(len(fmt.Sprintf(base64Trailer, a)))
+	case AssemblyEncoding:
+		if c.n == 0 {
+			return int64(len(fmt.Sprintf("\nvar vaultAssetBin%v = \"\"\n", a)))
+		}
+
+		// Every DATA directive contains up to 8 bytes, the size has one digit
+		lines := (c.n + 7) / 8
+		size := lines*int64(len(fmt.Sprintf(asmData, a, "", 8, ""))) + c.escaped
+		for k, digits, next := int64(0), int64(1), int64(10); k < lines; digits, next = digits+1, next*10 {
+			// The offsets 8*k below next have the same number of digits
+			end := (next + 7) / 8
+			if end > lines {
+				end = lines
+			}
+			size += (end - k) * digits
+			k = end
+		}
+		return size + int64(len(fmt.Sprintf(asmGlobl, a, c.n))+len(fmt.Sprintf(asmDecl, a, c.n)))
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InvalidPackageNameError is returned if the package name of the generated
+// files could not be determined or is not a valid identifier.
+type InvalidPackageNameError struct {
+	Name string
+}
+
+func (e *InvalidPackageNameError) Error() string {
+	if e.Name == "" {
+		return "could not determine package name: try to set package name manually"
+	}
+	return fmt.Sprintf("'%v' is an invalid package name: try to set a valid package name manually", e.Name)
+}
+
+// InvalidResourceNameError is returned if the resource name is not a valid identifier.
+type InvalidResourceNameError struct {
+	Name string
+}
+
+func (e *InvalidResourceNameError) Error() string {
+	return fmt.Sprintf("'%v' is an invalid resource name: try to set a valid resource name manually", e.Name)
+}
+
+// WalkError is returned if the source directory or one of its files could not be read.
+type WalkError struct {
+	Path string
+	Err  error
+}
+
+func (e *WalkError) Error() string {
+	return fmt.Sprintf("failed to walk source directory '%v': %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *WalkError) Unwrap() error {
+	return e.Err
+}
+
+// WriteError is returned if a generated file could not be written.
+type WriteError struct {
+	File string
+	Err  error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("failed to write file '%v': %v", e.File, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// PathCollisionError is returned if two files of the mounted source directories
+// end up at the same path in the vault or if a file collides with a directory.
+type PathCollisionError struct {
+	Path    string
+	Sources []string
+}
+
+func (e *PathCollisionError) Error() string {
+	return fmt.Sprintf("path '%v' in vault is used by more than one source: %v",
+		e.Path, strings.Join(e.Sources, ", "))
+}
+
+// InvalidOptionError is returned if a generator option has an invalid value.
+type InvalidOptionError struct {
+	Option string
+	Err    error
+}
+
+func (e *InvalidOptionError) Error() string {
+	return fmt.Sprintf("invalid value for option %v: %v", e.Option, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *InvalidOptionError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidPatternError is returned if an include, exclude or codec pattern is invalid.
+type InvalidPatternError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *InvalidPatternError) Error() string {
+	return fmt.Sprintf("invalid pattern '%v': %v", e.Pattern, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *InvalidPatternError) Unwrap() error {
+	return e.Err
+}
+
+// FileTooLargeError is returned if a file exceeds the size set with the MaxFileSizeOption.
+type FileTooLargeError struct {
+	Path      string
+	Size, Max int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file '%v' has %v bytes and exceeds the maximum file size of %v bytes", e.Path, e.Size, e.Max)
+}
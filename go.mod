@@ -1,3 +1,5 @@
 module github.com/go-sharp/vault/v2
 
+go 1.16
+
 require github.com/pkg/browser v0.0.0-20180916011732-0a3d74bf9ce4
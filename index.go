@@ -0,0 +1,89 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// defaultDirMode is the mode of directories, which were not walked, like the parents of a mount prefix.
+const defaultDirMode os.FileMode = 0555
+
+// dirModel is a directory of the vault, the release file declares all
+// directories sorted by path, so the loader finds them by binary search.
+type dirModel struct {
+	Path    string
+	ModTime time.Time
+	Mode    os.FileMode
+	// Size is the size of all files in the directory and its subdirectories.
+	Size int64
+	// Dirs and Files contain the indices of the subdirectories and files in the
+	// directory, both sorted by name.
+	Dirs, Files []int
+}
+
+// buildDirIndex returns all directories containing the given files, the root directory
+// is always included. The walked directories provide the metadata and are included
+// even if they are empty, if the EmptyDirsOption is set. The files must be sorted
+// by their path in the vault, a directory walked twice keeps the first metadata.
+func buildDirIndex(cfg GeneratorConfig, files []fileModel, walked []dirItem) []dirModel {
+	seen := map[string]bool{"/": true}
+	paths := []string{"/"}
+	add := func(dir string) {
+		for d := dir; !seen[d]; d = path.Dir(d) {
+			seen[d] = true
+			paths = append(paths, d)
+		}
+	}
+
+	for _, f := range files {
+		add(f.Path)
+	}
+
+	meta := map[string]dirItem{}
+	for _, dir := range walked {
+		if _, ok := meta[dir.path]; !ok {
+			meta[dir.path] = dir
+		}
+
+		if cfg.emptyDirs {
+			add(dir.path)
+		}
+	}
+	sort.Strings(paths)
+
+	dirs := make([]dirModel, len(paths))
+	index := make(map[string]int, len(paths))
+	for i, p := range paths {
+		dirs[i].Path = p
+		dirs[i].Mode = defaultDirMode
+		if dir, ok := meta[p]; ok {
+			dirs[i].ModTime = cfg.modTimeOf(dir.fi)
+			dirs[i].Mode = dir.fi.Mode().Perm()
+		}
+
+		index[p] = i
+		// The subdirectories of a parent are visited in the order of their names
+		if p != "/" {
+			parent := &dirs[index[path.Dir(p)]]
+			parent.Dirs = append(parent.Dirs, i)
+		}
+	}
+
+	for i, f := range files {
+		dirs[index[f.Path]].Files = append(dirs[index[f.Path]].Files, i)
+		for d := f.Path; ; d = path.Dir(d) {
+			dirs[index[d]].Size += f.Size
+			if d == "/" {
+				break
+			}
+		}
+	}
+	return dirs
+}
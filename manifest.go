@@ -0,0 +1,203 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// manifest records the inputs and outputs of a generator run,
+// so the next run can detect whether the vault is up to date.
+type manifest struct {
+	Version string          `json:"version"`
+	Options string          `json:"options"`
+	Files   []manifestEntry `json:"files"`
+	Dirs    []manifestEntry `json:"dirs,omitempty"`
+	Outputs []manifestEntry `json:"outputs"`
+}
+
+type manifestEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime,omitempty"`
+	Hash    string `json:"hash"`
+	// Mode is only recorded for directories
+	Mode os.FileMode `json:"mode,omitempty"`
+}
+
+// upToDate reports whether the manifest of the last run matches
+// the given source files, the configuration and the generated files.
+func (g *Generator) upToDate(ctx context.Context, items []fileItem, dirs []dirItem) (bool, error) {
+	data, err := ioutil.ReadFile(g.manifestFile)
+	if err != nil {
+		// A missing or unreadable manifest forces a regeneration
+		return false, nil
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false, nil
+	}
+
+	if m.Version != Version || m.Options != g.config.fingerprint() ||
+		len(m.Files) != len(items) || len(m.Dirs) != len(dirs) {
+		return false, nil
+	}
+
+	// The directories are recorded with their metadata in the vault
+	for i, dir := range dirs {
+		e := m.Dirs[i]
+		if e.Path != dir.path || e.ModTime != g.config.modTimeOf(dir.fi).Unix() || e.Mode != dir.fi.Mode().Perm() {
+			return false, nil
+		}
+	}
+
+	// The modification times are recorded as stored in the vault, with a fixed
+	// modification time a touched file is only detected by its content.
+	for i, item := range items {
+		e := m.Files[i]
+		if e.Path != path.Join(getPath(item.path), item.fi.Name()) ||
+			e.Size != item.fi.Size() || e.ModTime != g.config.modTimeOf(item.fi).Unix() {
+			return false, nil
+		}
+	}
+
+	// The outputs depend on the options and the files, so the
+	// outputs recorded in the manifest are the expected outputs.
+	for _, e := range m.Outputs {
+		out := path.Join(g.config.dest, e.Path)
+		if fi, err := os.Stat(out); err != nil || fi.Size() != e.Size {
+			return false, nil
+		}
+
+		if hash, err := hashFile(out); err != nil || hash != e.Hash {
+			return false, nil
+		}
+	}
+
+	// Size and modification time in the vault match, finally compare the content
+	for i, item := range items {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		hash, err := hashFile(item.fullpath)
+		if err != nil {
+			return false, &WalkError{Path: item.fullpath, Err: err}
+		}
+
+		if hash != m.Files[i].Hash {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// writeManifest writes the manifest for the generated files, an unchanged manifest is
+// kept untouched. The manifest records the modification times stored in the vault,
+// so it is identical on every machine if the vault contains fixed modification times.
+func (g *Generator) writeManifest(dirs []dirItem, files []fileModel) error {
+	m := manifest{Version: Version, Options: g.config.fingerprint()}
+	for _, dir := range dirs {
+		m.Dirs = append(m.Dirs, manifestEntry{Path: dir.path, ModTime: g.config.modTimeOf(dir.fi).Unix(), Mode: dir.fi.Mode().Perm()})
+	}
+	for _, f := range files {
+		m.Files = append(m.Files, manifestEntry{
+			Path:    path.Join(f.Path, f.Name),
+			Size:    f.Size,
+			ModTime: f.ModTime.Unix(),
+			Hash:    f.Hash,
+		})
+	}
+
+	for _, out := range g.outputFiles() {
+		fi, err := os.Stat(out)
+		if err != nil {
+			return &WriteError{File: g.manifestFile, Err: err}
+		}
+
+		hash, err := hashFile(out)
+		if err != nil {
+			return &WriteError{File: g.manifestFile, Err: err}
+		}
+
+		m.Outputs = append(m.Outputs, manifestEntry{Path: path.Base(out), Size: fi.Size(), Hash: hash})
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return &WriteError{File: g.manifestFile, Err: err}
+	}
+
+	data = append(data, '\n')
+	if old, err := ioutil.ReadFile(g.manifestFile); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(g.manifestFile, data, 0600); err != nil {
+		return &WriteError{File: g.manifestFile, Err: err}
+	}
+	return nil
+}
+
+// outputFiles returns all files written by the last run except the manifest.
+func (g *Generator) outputFiles() []string {
+	files := []string{g.sharedFile}
+	if g.config.debugFile {
+		files = append(files, g.debugFile)
+	}
+	return append(append(files, g.releaseFile), g.dataFiles...)
+}
+
+// fingerprint returns a hash of all settings affecting the generated files.
+func (cfg GeneratorConfig) fingerprint() string {
+	h := sha256.New()
+	// The source directory of the primary mount is replaced by the relative path in the
+	// debug file, the source files themselves are compared by the manifest entries
+	for _, m := range cfg.mounts {
+		if m.primary && cfg.relPath != "" {
+			fmt.Fprintf(h, "mount=%q:relPath=%q\n", m.prefix, cfg.relPath)
+			continue
+		}
+		fmt.Fprintf(h, "mount=%q:%q\n", m.prefix, m.src)
+	}
+	fmt.Fprintf(h, "name=%q\n", cfg.name)
+	fmt.Fprintf(h, "pkgName=%q\n", cfg.pkgName)
+	fmt.Fprintf(h, "syntax=%v\n", cfg.syntax)
+	fmt.Fprintf(h, "excl=%q\n", cfg.excl)
+	fmt.Fprintf(h, "incl=%q\n", cfg.incl)
+	fmt.Fprintf(h, "withSubdirs=%v\n", cfg.withSubdirs)
+	fmt.Fprintf(h, "emptyDirs=%v\n", cfg.emptyDirs)
+	fmt.Fprintf(h, "ignoreFiles=%v\n", cfg.ignoreFiles)
+	fmt.Fprintf(h, "followLinks=%v\n", cfg.followLinks)
+	fmt.Fprintf(h, "linkAliases=%v\n", cfg.linkAliases)
+	fmt.Fprintf(h, "compress=%v\n", cfg.compress)
+	fmt.Fprintf(h, "codec=%v\n", cfg.codec)
+	for _, r := range cfg.codecRules {
+		fmt.Fprintf(h, "codecRule=%v:%q\n", r.codec, r.pats)
+	}
+	fmt.Fprintf(h, "cmpLvl=%v\n", cfg.cmpLvl)
+	fmt.Fprintf(h, "minSavings=%v\n", cfg.minSavings)
+	fmt.Fprintf(h, "skipCompressed=%v\n", cfg.skipCompressed)
+	fmt.Fprintf(h, "encoding=%v\n", cfg.encoding)
+	fmt.Fprintf(h, "shardSize=%v\n", cfg.shardSize)
+	fmt.Fprintf(h, "blockSize=%v\n", cfg.blockSize)
+	fmt.Fprintf(h, "buildTag=%q\n", cfg.buildTag)
+	fmt.Fprintf(h, "debugFile=%v\n", cfg.debugFile)
+	if cfg.fixedModTime {
+		fmt.Fprintf(h, "modTime=%v\n", cfg.modTime.Unix())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
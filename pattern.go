@@ -0,0 +1,200 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PatternSyntax defines how include, exclude and codec patterns are interpreted.
+type PatternSyntax uint8
+
+const (
+	// RegexpSyntax interprets patterns as regular expressions (default).
+	// A file matches if any pattern matches its path in the vault (ex. /data/css.css).
+	RegexpSyntax PatternSyntax = iota
+	// GlobSyntax interprets patterns like the rules of a .gitignore file.
+	// A pattern without slash matches files and directories at any level, otherwise
+	// it is anchored at the root of the vault. "*" and "?" do not match a slash, "**"
+	// matches any number of directories, a trailing slash matches directories only.
+	// Rules are evaluated in order, the last matching rule wins and
+	// a rule starting with "!" negates the match of previous rules.
+	GlobSyntax
+)
+
+// patterns is a list of raw patterns as passed to the generator options.
+type patterns []string
+
+// matcher is a compiled list of patterns.
+type matcher struct {
+	rules []rule
+}
+
+type rule struct {
+	re      *regexp.Regexp
+	glob    bool
+	negate  bool
+	dirOnly bool
+}
+
+// compilePatterns compiles all patterns with the given syntax,
+// an InvalidPatternError is returned for the first invalid pattern.
+func compilePatterns(syntax PatternSyntax, pats patterns) (matcher, error) {
+	var m matcher
+	for _, p := range pats {
+		r, ok, err := compileRule(syntax, p)
+		if err != nil {
+			return matcher{}, &InvalidPatternError{Pattern: p, Err: err}
+		}
+
+		if ok {
+			m.rules = append(m.rules, r)
+		}
+	}
+	return m, nil
+}
+
+// compileRule compiles a single pattern, ok is false if the pattern
+// is empty or a comment and therefore contains no rule.
+func compileRule(syntax PatternSyntax, p string) (r rule, ok bool, err error) {
+	if syntax == RegexpSyntax {
+		r.re, err = regexp.Compile(p)
+		return r, err == nil, err
+	}
+
+	p = strings.TrimRight(p, " ")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return r, false, nil
+	}
+
+	r.glob = true
+	if strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+
+	if p == "" {
+		return r, false, errors.New("empty pattern")
+	}
+
+	expr, err := globToRegexp(p)
+	if err != nil {
+		return r, false, err
+	}
+
+	r.re, err = regexp.Compile(expr)
+	return r, err == nil, err
+}
+
+// globToRegexp translates a gitignore-style glob into a regular expression
+// matching slash separated paths relative to the root (without leading slash).
+func globToRegexp(p string) (string, error) {
+	var b strings.Builder
+
+	// A pattern containing a slash is relative to the root,
+	// otherwise it matches at any level.
+	if strings.Contains(p, "/") {
+		b.WriteString("^")
+	} else {
+		b.WriteString("^(?:.*/)?")
+	}
+	p = strings.TrimPrefix(p, "/")
+
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case strings.HasPrefix(p[i:], "**/") && (i == 0 || p[i-1] == '/'):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case p[i:] == "**" && i > 0 && p[i-1] == '/':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\':
+			if i+1 == len(p) {
+				return "", errors.New("trailing backslash")
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		case c == '[':
+			// A closing bracket right after the opening bracket (or negation) is a literal
+			j := i + 1
+			if j < len(p) && (p[j] == '!' || p[j] == '^') {
+				j++
+			}
+			if j < len(p) && p[j] == ']' {
+				j++
+			}
+
+			end := strings.IndexByte(p[j:], ']')
+			if end == -1 {
+				return "", errors.New("unterminated character class")
+			}
+			end += j
+
+			class := p[i+1 : end]
+			b.WriteString("[")
+			if class[0] == '!' || class[0] == '^' {
+				b.WriteString("^/")
+				class = class[1:]
+			}
+			b.WriteString(strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(class))
+			b.WriteString("]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// matches reports whether the file with the given vault path (ex. /data/css.css) matches.
+func (m matcher) matches(vaultPath string) bool {
+	var matched bool
+	for _, r := range m.rules {
+		if r.matchesFile(vaultPath) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+// empty reports whether the matcher contains no rules.
+func (m matcher) empty() bool {
+	return len(m.rules) == 0
+}
+
+// matchesFile reports whether the rule matches the file or one of its parent directories.
+func (r rule) matchesFile(vaultPath string) bool {
+	if !r.glob {
+		return r.re.MatchString(vaultPath)
+	}
+
+	rel := strings.TrimPrefix(vaultPath, "/")
+	if !r.dirOnly && r.re.MatchString(rel) {
+		return true
+	}
+
+	for d := path.Dir(rel); d != "." && d != "/"; d = path.Dir(d) {
+		if r.re.MatchString(d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// minShardSize is the smallest shard size accepted by the ShardSizeOption.
+	minShardSize = 64 * 1024
+	// shardChunkSize is the number of bytes written at once into a shard,
+	// a shard is only full if the next chunk does not fit.
+	shardChunkSize = 1024
+)
+
+// shardWriter writes the data of the vault. Without a shard size the data is
+// declared in the release file, otherwise it is split into shard files
+// release_<name>_vault_000.go, ... which do not exceed the shard size.
+type shardWriter struct {
+	g         *Generator
+	assetName string
+	// w is the writer of the release file
+	w   io.Writer
+	enc dataEncoder
+	// size counts the bytes written into the data file of the current shard
+	size   countWriter
+	offset int64
+	// names contains the names of the data variables of all shards
+	names []string
+	// files contains all data files written, the release file excluded
+	files []dataFile
+}
+
+// dataFile is written into a temporary file first.
+type dataFile struct {
+	name, tmp string
+	f         *os.File
+}
+
+// open starts the declaration of the data in the release file or opens the first shard.
+func (s *shardWriter) open() error {
+	if s.g.config.shardSize > 0 {
+		return s.openShard()
+	}
+
+	var err error
+	var asm io.Writer = ioutil.Discard
+	if s.g.config.encoding == AssemblyEncoding {
+		if asm, err = s.createAsm(s.g.asmFile); err != nil {
+			return err
+		}
+	}
+
+	s.names = append(s.names, s.assetName)
+	s.enc, err = newDataEncoder(s.g.config.encoding, s.w, asm, s.assetName)
+	return err
+}
+
+// create creates the temporary file for the data file name.
+func (s *shardWriter) create(name string) (io.Writer, error) {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, &WriteError{File: tmp, Err: err}
+	}
+
+	s.files = append(s.files, dataFile{name: name, tmp: tmp, f: f})
+	return fileWriter{name: name, w: f}, nil
+}
+
+// createAsm creates the temporary file for the assembly file name and writes its header.
+func (s *shardWriter) createAsm(name string) (io.Writer, error) {
+	w, err := s.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return w, fprintf(w, "%v%v", s.g.config.buildConstraint(false), asmHeader)
+}
+
+// openShard creates the files of the next shard and starts the declaration of its data.
+func (s *shardWriter) openShard() error {
+	idx := len(s.names)
+	name := fmt.Sprintf("%v_%03d", s.assetName, idx)
+
+	w, err := s.create(s.g.shardFile(idx, ".go"))
+	if err != nil {
+		return err
+	}
+
+	// The size of a shard includes the header
+	s.size = countWriter{}
+	var asm io.Writer = ioutil.Discard
+	if s.g.config.encoding == AssemblyEncoding {
+		if asm, err = s.createAsm(s.g.shardFile(idx, ".s")); err != nil {
+			return err
+		}
+		asm = io.MultiWriter(asm, &s.size)
+	} else {
+		w = io.MultiWriter(w, &s.size)
+	}
+
+	if err := fprintf(w, "%v", s.g.config.buildConstraint(false)); err != nil {
+		return err
+	}
+
+	if err := execTempl(w, ttFileHeaderTempl, s.g.config.pkgName); err != nil {
+		return err
+	}
+
+	if err := execTempl(w, ttShardImportTempl, s.g.config.encoding.String()); err != nil {
+		return err
+	}
+
+	s.names = append(s.names, name)
+	s.offset = 0
+	s.enc, err = newDataEncoder(s.g.config.encoding, w, asm, name)
+	return err
+}
+
+// write writes the data of a file and returns the shard and offset of its first byte.
+// The data of a file is split over several shards if it does not fit into the current shard.
+func (s *shardWriter) write(p []byte) (shard int, offset int64, err error) {
+	shard, offset = len(s.names)-1, s.offset
+	if s.g.config.shardSize == 0 {
+		s.offset += int64(len(p))
+		return shard, offset, s.enc.write(p)
+	}
+
+	for start := true; len(p) > 0; start = false {
+		n := shardChunkSize
+		if n > len(p) {
+			n = len(p)
+		}
+
+		// A shard contains at least one chunk, so a file always fits eventually
+		if s.offset > 0 && s.size.n+s.enc.maxSize(n) > s.g.config.shardSize {
+			if err := s.enc.close(); err != nil {
+				return 0, 0, err
+			}
+
+			if err := s.openShard(); err != nil {
+				return 0, 0, err
+			}
+
+			if start {
+				shard, offset = len(s.names)-1, 0
+			}
+		}
+
+		if err := s.enc.write(p[:n]); err != nil {
+			return 0, 0, err
+		}
+		s.offset += int64(n)
+		p = p[n:]
+	}
+	return shard, offset, nil
+}
+
+// close terminates the data of the last shard and closes all data files.
+func (s *shardWriter) close() error {
+	var err error
+	if s.enc != nil {
+		err = s.enc.close()
+	}
+	for _, f := range s.files {
+		if cerr := f.f.Close(); cerr != nil && err == nil {
+			err = &WriteError{File: f.name, Err: cerr}
+		}
+	}
+	return err
+}
+
+// commit replaces the data files with the temporary files and removes
+// data files of previous runs, which would declare the data twice.
+func (s *shardWriter) commit() error {
+	written := map[string]bool{}
+	for _, f := range s.files {
+		if err := replaceFile(f.tmp, f.name); err != nil {
+			return err
+		}
+		written[f.name] = true
+	}
+
+	// The pattern also matches the release file of a vault named <name>_vault_000,
+	// so only names with digits between the prefix and the extension are shard files
+	stale := []string{s.g.asmFile}
+	for _, ext := range []string{".go", ".s"} {
+		prefix := fmt.Sprintf("%v/release_%v_vault_", s.g.config.dest, s.g.config.name)
+		matches, err := filepath.Glob(prefix + "[0-9][0-9][0-9]*" + ext)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range matches {
+			if isDigits(strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext)) {
+				stale = append(stale, m)
+			}
+		}
+	}
+
+	for _, name := range stale {
+		if written[name] {
+			continue
+		}
+
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return &WriteError{File: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// cleanup removes the temporary files left by a failed run.
+func (s *shardWriter) cleanup() {
+	for _, f := range s.files {
+		f.f.Close()
+		os.Remove(f.tmp)
+	}
+}
+
+// dataFiles returns the names of all data files written.
+func (s *shardWriter) dataFiles() []string {
+	var names []string
+	for _, f := range s.files {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+// shardFile returns the name of the shard file with the given index and extension.
+// The number 386 is skipped, the go tool builds a file ending with _386 only for GOARCH=386.
+func (g *Generator) shardFile(idx int, ext string) string {
+	if idx >= 386 {
+		idx++
+	}
+	return fmt.Sprintf("%v/release_%v_vault_%03d%v", g.config.dest, g.config.name, idx, ext)
+}
+
+// isDigits reports whether s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
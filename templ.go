@@ -7,93 +7,734 @@ package vault
 
 const sharedTypesTempl = `
 import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // AssetLoader implements a function to load an asset from the vault
 type AssetLoader interface {
 	// Open loads a file from the vault.
 	Open(name string) (http.File, error)
+	// Hash returns the hex encoded SHA-256 hash of the file content.
+	Hash(name string) (string, error)
+	// FS returns the vault as fs.FS, which implements fs.ReadDirFS, fs.ReadFileFS,
+	// fs.StatFS, fs.GlobFS and fs.SubFS as well.
+	FS() fs.FS
+	// ReadFile returns the content of a file.
+	ReadFile(name string) ([]byte, error)
+	// ReadString returns the content of a file as string. The content of a file
+	// stored uncompressed is returned without copying.
+	ReadString(name string) (string, error)
+	// MustReadFile returns the content of a file and panics on any error.
+	MustReadFile(name string) []byte
+	// Exists reports whether a file or directory exists in the vault.
+	Exists(name string) bool
+	// Names returns the paths of all files in the vault sorted lexically.
+	Names() []string
+	// Walk walks the files and directories below root in lexical order and calls
+	// fn with their path in the vault (see fs.WalkDir).
+	Walk(root string, fn fs.WalkDirFunc) error
+	// CacheStats returns the counters of the content cache.
+	CacheStats() CacheStats
+}
+
+// LoaderOption configures a loader.
+type LoaderOption func(c *loaderConfig)
+
+type loaderConfig struct {
+	cache CachePolicy
+}
+
+// CacheOption sets the policy of the cache of decompressed file contents, default is NoCache.
+// Files stored uncompressed are never cached, they are read directly from the vault.
+// A file is looked up in the cache when it is read the first time, not when it is opened.
+// The debug loader reads the files from disk and never caches.
+func CacheOption(policy CachePolicy) LoaderOption {
+	return func(c *loaderConfig) {
+		c.cache = policy
+	}
+}
+
+// CachePolicy defines which decompressed file contents a loader keeps in memory.
+type CachePolicy struct {
+	eager   bool
+	maxSize int64
+}
+
+var (
+	// NoCache decompresses a file every time it is opened and read.
+	NoCache = CachePolicy{}
+	// EagerCache decompresses all files at the first read and keeps them in memory.
+	EagerCache = CachePolicy{eager: true}
+)
+
+// LRUCache keeps the decompressed contents of the recently read files in memory,
+// as long as their total size does not exceed maxSize bytes. Files larger than
+// maxSize bypass the cache.
+func LRUCache(maxSize int64) CachePolicy {
+	return CachePolicy{maxSize: maxSize}
+}
+
+// CacheStats contains the counters of the content cache of a loader.
+type CacheStats struct {
+	// Hits and Misses count the files found or not found in the cache at their first read
+	Hits, Misses uint64
+	// Size is the number of decompressed bytes in the cache
+	Size int64
+}
+
+// vaultCache caches decompressed file contents, it is safe for concurrent use.
+type vaultCache struct {
+	policy CachePolicy
+	once   sync.Once
+	mu     sync.Mutex
+	// lru contains the entries, the most recently used entry first
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+type vaultCacheEntry struct {
+	name, data string
+}
+
+func newVaultCache(options []LoaderOption) *vaultCache {
+	var cfg loaderConfig
+	for _, o := range options {
+		o(&cfg)
+	}
+	return &vaultCache{policy: cfg.cache, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// caches reports whether the policy caches the content of a file of the given size.
+func (c *vaultCache) caches(size int64) bool {
+	return c.policy.eager || (c.policy.maxSize > 0 && size <= c.policy.maxSize)
+}
+
+// get returns the cached content of the file name, the content is loaded on a miss.
+// The eager policy loads all files with loadAll before the first access.
+func (c *vaultCache) get(name string, load func() (string, error), loadAll func()) (string, error) {
+	if c.policy.eager {
+		c.once.Do(loadAll)
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[name]; ok {
+		c.lru.MoveToFront(e)
+		c.stats.Hits++
+		c.mu.Unlock()
+		return e.Value.(*vaultCacheEntry).data, nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	data, err := load()
+	if err != nil {
+		return "", err
+	}
+	c.add(name, data)
+	return data, nil
+}
+
+// add adds the content to the cache and removes the least recently used
+// entries if the cache exceeds the maximum size.
+func (c *vaultCache) add(name, data string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[name]; ok || (!c.policy.eager && int64(len(data)) > c.policy.maxSize) {
+		return
+	}
+
+	c.entries[name] = c.lru.PushFront(&vaultCacheEntry{name: name, data: data})
+	c.stats.Size += int64(len(data))
+	for !c.policy.eager && c.stats.Size > c.policy.maxSize {
+		e := c.lru.Remove(c.lru.Back()).(*vaultCacheEntry)
+		delete(c.entries, e.name)
+		c.stats.Size -= int64(len(e.data))
+	}
+}
+
+func (c *vaultCache) statistics() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// vaultReadFile implements AssetLoader.ReadFile.
+func vaultReadFile(l AssetLoader, name string) ([]byte, error) {
+	f, err := l.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return nil, fmt.Errorf("ReadFile: '%v' is a directory", name)
+	}
+	return io.ReadAll(f)
+}
+
+// vaultMustReadFile implements AssetLoader.MustReadFile.
+func vaultMustReadFile(l AssetLoader, name string) []byte {
+	data, err := l.ReadFile(name)
+	if err != nil {
+		panic(fmt.Sprintf("MustReadFile: '%v': %v", name, err))
+	}
+	return data
+}
+
+// vaultExists implements AssetLoader.Exists.
+func vaultExists(l AssetLoader, name string) bool {
+	f, err := l.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// vaultWalk implements AssetLoader.Walk with fs.WalkDir.
+func vaultWalk(l AssetLoader, root string, fn fs.WalkDirFunc) error {
+	root = strings.TrimPrefix(path.Clean("/"+root), "/")
+	if root == "" {
+		root = "."
+	}
+
+	return fs.WalkDir(l.FS(), root, func(name string, d fs.DirEntry, err error) error {
+		return fn(path.Join("/", name), d, err)
+	})
+}
+
+// vaultFS implements the io/fs interfaces with an AssetLoader, the names
+// are relative to the directory dir of the vault.
+type vaultFS struct {
+	l   AssetLoader
+	dir string
+}
+
+func (v vaultFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	f, err := v.l.Open(path.Join("/", v.dir, name))
+	if err != nil {
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return vaultFile{File: f, name: path.Base(name)}, nil
+}
+
+func (v vaultFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.(vaultFile).ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+func (v vaultFS) ReadFile(name string) ([]byte, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return io.ReadAll(f)
+}
+
+func (v vaultFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// Glob uses fs.Glob, which reads the directories with ReadDir.
+func (v vaultFS) Glob(pattern string) ([]string, error) {
+	return fs.Glob(struct{ fs.ReadDirFS }{v}, pattern)
+}
+
+func (v vaultFS) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	return vaultFS{l: v.l, dir: path.Join(v.dir, dir)}, nil
+}
+
+// vaultFile implements fs.ReadDirFile with a http.File,
+// the file info carries the name of the file in the vault.
+type vaultFile struct {
+	http.File
+	name string
+}
+
+func (f vaultFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return vaultFileInfo{FileInfo: fi, name: f.name}, nil
+}
+
+func (f vaultFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	fis, err := f.Readdir(n)
+	if err == io.EOF && len(fis) > 0 {
+		err = nil
+	}
+
+	entries := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		entries[i] = vaultDirEntry{fi}
+	}
+	return entries, err
+}
+
+type vaultFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi vaultFileInfo) Name() string {
+	return fi.name
+}
+
+// vaultDirEntry implements fs.DirEntry with the file info of a directory entry.
+type vaultDirEntry struct {
+	fs.FileInfo
+}
+
+func (e vaultDirEntry) Type() fs.FileMode {
+	return e.Mode().Type()
+}
+
+func (e vaultDirEntry) Info() (fs.FileInfo, error) {
+	return e.FileInfo, nil
+}
+
+// IntegrityError is returned by Read if the content of a file
+// does not match the hash or the size recorded in the vault.
+type IntegrityError struct {
+	Name string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check of '%v' failed: content does not match hash or size", e.Name)
 }
 `
 
 const releaseImportTempl = `
 import (
+{{- if .Codecs.deflate}}
+	"compress/flate"
+{{- end}}
+{{- if .Codecs.gzip}}
+	"compress/gzip"
+{{- end}}
+{{- if .Codecs.lzw}}
+	"compress/lzw"
+{{- end}}
+{{- if .Codecs.zlib}}
 	"compress/zlib"
+{{- end}}
+	"crypto/sha256"
+{{- if eq .Encoding "base64"}}
+	"encoding/base64"
+{{- end}}
+	"encoding/hex"
 	"errors"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"net/http"
+{{- if eq .Encoding "asm"}}
+	"unsafe"
+{{- end}}
 )
 
 `
 
 const releaseFileTempl = `
-type assetReader interface {
-	io.ReadCloser
-	zlib.Resetter
+// resetter{{.Suffix}} is implemented by decompressors which can be reused.
+type resetter{{.Suffix}} interface {
+	Reset(r io.Reader, dict []byte) error
 }
 
-type memFile struct {
-	r       assetReader
+// Codecs used in this vault
+const (
+{{- range $name, $ok := .Codecs}}
+	codec{{title $name}}{{$.Suffix}} = {{codec $name | printf "%d"}}
+{{- end}}
+)
+
+type memFile{{.Suffix}} struct {
+	r       io.ReadCloser
 	rOffset int64
 	offset  int64
 	name    string
-	modTime time.Time
+	modTime int64
 	path    string
 	length  int64
 	size    int64
+	shard   int
+	codec   uint8
+	hash    string
+	// blocks contains the end offsets of the compressed blocks of blockSize
+	// uncompressed bytes, nil if the file is compressed as one block
+	blocks    []int64
+	blockSize int64
+	// block is the index of the block read by r
+	block int
+	// past is the distance of the position set by Seek beyond the end of the file,
+	// the reader stays at the end in this case
+	past int64
+	// cache references the cached content, nil if the file is not cached
+	cache *string
+	// lookup looks up the content in vc at the first read, nil if the file bypasses the cache
+	lookup *sync.Once
+	vc     *vaultCache
+	// h hashes the content read so far, it is verified at EOF. It is nil
+	// if the reader skipped a part of the content.
+	h hash.Hash
 }
 
 // Readdir see os.File Readdir function
-func (m memFile) Readdir(count int) ([]os.FileInfo, error) {
+func (m memFile{{.Suffix}}) Readdir(count int) ([]os.FileInfo, error) {
 	return []os.FileInfo{}, io.EOF
 }
 
-func (m memFile) Close() error {
+// Close returns the decompressor to its pool.
+func (m *memFile{{.Suffix}}) Close() error {
 	if m.r == nil {
 		return nil
 	}
-	return m.r.Close()
+	return m.releaseReader()
 }
 
-func (m *memFile) resetReader() (err error) {
-	if m.r == nil {
-		var r io.ReadCloser
-		r, err = zlib.NewReader(strings.NewReader(vaultAssetBin{{.Suffix}}[m.offset : m.offset+m.length]))
-		m.r = r.(assetReader)
-	} else {
-		err = m.r.Reset(strings.NewReader(vaultAssetBin{{.Suffix}}[m.offset:m.offset+m.length]), nil)
-	}
+// Pools of decompressors shared by all files, a decompressor is returned to its pool
+// when the file is closed. The lzw reader can not be reset and is never reused.
+var (
+{{- if .Codecs.zlib}}
+	zlibPool{{.Suffix}} sync.Pool
+{{- end}}
+{{- if .Codecs.deflate}}
+	deflatePool{{.Suffix}} sync.Pool
+{{- end}}
+{{- if .Codecs.gzip}}
+	gzipPool{{.Suffix}} sync.Pool
+{{- end}}
+)
 
-	if err != nil {
+// releaseReader closes the reader and returns a decompressor to its pool.
+func (m *memFile{{.Suffix}}) releaseReader() error {
+	r := m.r
+	m.r = nil
+	err := r.Close()
+	if m.cache != nil || err != nil {
 		return err
 	}
 
-	m.rOffset = 0
+	switch m.codec {
+{{- if .Codecs.zlib}}
+	case codecZlib{{.Suffix}}:
+		zlibPool{{.Suffix}}.Put(r)
+{{- end}}
+{{- if .Codecs.deflate}}
+	case codecDeflate{{.Suffix}}:
+		deflatePool{{.Suffix}}.Put(r)
+{{- end}}
+{{- if .Codecs.gzip}}
+	case codecGzip{{.Suffix}}:
+		gzipPool{{.Suffix}}.Put(r)
+{{- end}}
+	}
 	return nil
 }
 
-func (m *memFile) Read(p []byte) (n int, err error) {
+// vaultAssetShards{{.Suffix}} references the data of all shards.
+var vaultAssetShards{{.Suffix}} = []*string{
+{{- range .Shards}}
+	&vaultAssetBin{{.}},
+{{- end}}
+}
+
+// dataReader returns a reader for length bytes of the raw data of the file starting
+// at offset, the data of a file may continue in the following shards.
+func (m *memFile{{.Suffix}}) dataReader(offset, length int64) io.Reader {
+	shard, offset := m.shard, m.offset+offset
+	for shard+1 < len(vaultAssetShards{{.Suffix}}) && offset >= int64(len(*vaultAssetShards{{.Suffix}}[shard])) {
+		offset -= int64(len(*vaultAssetShards{{.Suffix}}[shard]))
+		shard++
+	}
+
+	var rs []io.Reader
+	for {
+		data := (*vaultAssetShards{{.Suffix}}[shard])[offset:]
+		if int64(len(data)) >= length {
+			rs = append(rs, strings.NewReader(data[:length]))
+			break
+		}
+
+		rs = append(rs, strings.NewReader(data))
+		length -= int64(len(data))
+		shard, offset = shard+1, 0
+	}
+
+	if len(rs) == 1 {
+		return rs[0]
+	}
+	return io.MultiReader(rs...)
+}
+
+// blockOf returns the index of the block containing the offset.
+func (m *memFile{{.Suffix}}) blockOf(offset int64) int {
+	if len(m.blocks) == 0 {
+		return 0
+	}
+
+	if i := int(offset / m.blockSize); i < len(m.blocks) {
+		return i
+	}
+	return len(m.blocks) - 1
+}
+
+// blockRange returns the offset and the length of the compressed block i in the data of the file.
+func (m *memFile{{.Suffix}}) blockRange(i int) (int64, int64) {
+	if len(m.blocks) == 0 {
+		return 0, m.length
+	}
+
+	var start int64
+	if i > 0 {
+		start = m.blocks[i-1]
+	}
+	return start, m.blocks[i] - start
+}
+
+// openBlock starts decompressing the block i.
+func (m *memFile{{.Suffix}}) openBlock(i int) error {
+	r := m.dataReader(m.blockRange(i))
+	if rs, ok := m.r.(resetter{{.Suffix}}); ok {
+		if err := rs.Reset(r, nil); err != nil {
+			return err
+		}
+	} else {
+		if m.r != nil {
+			m.releaseReader()
+		}
+
+		nr, err := m.newReader(r)
+		if err != nil {
+			return err
+		}
+		m.r = nr
+	}
+
+	m.block = i
+	return nil
+}
+
+// seek positions the reader at offset. A compressed file is positioned at the start
+// of the block containing offset and the remaining bytes of the block are skipped,
+// a stored file is positioned without reading.
+func (m *memFile{{.Suffix}}) seek(offset int64) error {
+	if offset > m.size {
+		offset = m.size
+	}
+
+	if m.r != nil && offset == m.rOffset {
+		return nil
+	}
+
+	m.loadCache()
+	// The cached content was verified when it was loaded
+	if m.cache != nil {
+		m.r = io.NopCloser(strings.NewReader((*m.cache)[offset:]))
+		m.rOffset, m.h = offset, nil
+		return nil
+	}
+{{if .Codecs.stored}}
+	if m.codec == codecStored{{.Suffix}} {
+		m.r = io.NopCloser(m.dataReader(offset, m.length-offset))
+		m.rOffset, m.h = offset, nil
+		if offset == 0 {
+			m.h = sha256.New()
+		}
+		return nil
+	}
+{{end}}
+	if i := m.blockOf(offset); m.r == nil || offset < m.rOffset || i != m.block {
+		if err := m.openBlock(i); err != nil {
+			return err
+		}
+
+		m.rOffset, m.h = int64(i)*m.blockSize, nil
+		if m.rOffset == 0 {
+			m.h = sha256.New()
+		}
+	}
+
+	_, err := io.CopyN(io.Discard, m, offset-m.rOffset)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// loadCache looks up the content in the cache once, the content is decompressed on a miss.
+// It is safe for concurrent use by ReadAt.
+func (m *memFile{{.Suffix}}) loadCache() {
+	if m.lookup == nil {
+		return
+	}
+
+	m.lookup.Do(func() {
+		data, err := m.vc.get(strings.TrimSuffix(m.path, "/")+"/"+m.name, func() (string, error) {
+			return readAll{{.Suffix}}(*m.clone())
+		}, func() { loadAll{{.Suffix}}(m.vc) })
+
+		// Reading the file reports the error again
+		if err == nil {
+			m.cache = &data
+		}
+	})
+}
+
+// clone returns an unread copy of the file, which does not use the cache.
+func (m *memFile{{.Suffix}}) clone() *memFile{{.Suffix}} {
+	return &memFile{{.Suffix}}{offset: m.offset, name: m.name, path: m.path, length: m.length, size: m.size,
+		shard: m.shard, codec: m.codec, hash: m.hash, blocks: m.blocks, blockSize: m.blockSize}
+}
+
+// content returns the content of a stored or cached file without copying, ok is false
+// if the file is compressed or its data is split over several shards.
+func (m *memFile{{.Suffix}}) content() (s string, ok bool) {
+	m.loadCache()
+	if m.cache != nil {
+		return *m.cache, true
+	}
+{{- if .Codecs.stored}}
+	data := *vaultAssetShards{{.Suffix}}[m.shard]
+	if m.codec != codecStored{{.Suffix}} || m.offset+m.length > int64(len(data)) {
+		return "", false
+	}
+	return data[m.offset : m.offset+m.length], true
+{{- else}}
+	return "", false
+{{- end}}
+}
+
+// newReader returns a reader decompressing r with the codec of the file,
+// a decompressor of the pool is reused if available.
+func (m *memFile{{.Suffix}}) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch m.codec {
+{{- if .Codecs.stored}}
+	case codecStored{{.Suffix}}:
+		return io.NopCloser(r), nil
+{{- end}}
+{{- if .Codecs.zlib}}
+	case codecZlib{{.Suffix}}:
+		if zr, ok := zlibPool{{.Suffix}}.Get().(io.ReadCloser); ok {
+			if err := zr.(resetter{{.Suffix}}).Reset(r, nil); err == nil {
+				return zr, nil
+			}
+		}
+		return zlib.NewReader(r)
+{{- end}}
+{{- if .Codecs.deflate}}
+	case codecDeflate{{.Suffix}}:
+		if fr, ok := deflatePool{{.Suffix}}.Get().(io.ReadCloser); ok {
+			if err := fr.(resetter{{.Suffix}}).Reset(r, nil); err == nil {
+				return fr, nil
+			}
+		}
+		return flate.NewReader(r), nil
+{{- end}}
+{{- if .Codecs.gzip}}
+	case codecGzip{{.Suffix}}:
+		if gr, ok := gzipPool{{.Suffix}}.Get().(*gzip.Reader); ok {
+			if err := gr.Reset(r); err == nil {
+				return gr, nil
+			}
+		}
+		return gzip.NewReader(r)
+{{- end}}
+{{- if .Codecs.lzw}}
+	case codecLzw{{.Suffix}}:
+		return lzw.NewReader(r, lzw.LSB, 8), nil
+{{- end}}
+	}
+	return nil, fmt.Errorf("unknown codec %v", m.codec)
+}
+
+func (m *memFile{{.Suffix}}) Read(p []byte) (n int, err error) {
+	if m.past > 0 {
+		return 0, io.EOF
+	}
+
 	if m.r == nil {
-		if err := m.resetReader(); err != nil {
+		if err := m.seek(0); err != nil {
 			return 0, err
 		}
 	}
 
 	n, err = m.r.Read(p)
+
+	// The blocks are independent streams, continue with the next block
+	if err == io.EOF && m.cache == nil && m.block+1 < len(m.blocks) {
+		if err = m.openBlock(m.block + 1); err == nil && n == 0 {
+			return m.Read(p)
+		}
+	}
+
 	m.rOffset += int64(n)
+	if m.h != nil {
+		m.h.Write(p[:n])
+	}
+
+	// Verify the content, the hash is only verified if the content was read from the start.
+	if m.rOffset > m.size || (err == io.EOF && (m.rOffset != m.size ||
+		(m.h != nil && hex.EncodeToString(m.h.Sum(nil)) != m.hash))) {
+		return n, &IntegrityError{Name: strings.TrimSuffix(m.path, "/") + "/" + m.name}
+	}
 	return n, err
 }
 
-func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+func (m *memFile{{.Suffix}}) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
 	case io.SeekCurrent:
-		offset += m.rOffset
+		offset += m.rOffset + m.past
 	case io.SeekStart:
 	case io.SeekEnd:
 		offset += m.size
@@ -103,68 +744,115 @@ func (m *memFile) Seek(offset int64, whence int) (int64, error) {
 	}
 
 	if offset < 0 {
-		return m.rOffset, errors.New("Seek: invalid offset")
+		return m.rOffset + m.past, errors.New("Seek: invalid offset")
 	}
 
-	if offset < m.rOffset {
-		if err := m.resetReader(); err != nil {
-			return m.rOffset, err
+	// Seeking beyond the end is allowed, the next Read returns io.EOF
+	m.past = 0
+	if err := m.seek(offset); err != nil {
+		return m.rOffset, err
+	}
+
+	if offset > m.size {
+		m.past = offset - m.size
+	}
+	return offset, nil
+}
+
+// ReadAt decompresses the blocks containing the requested range with its own reader,
+// so ReadAt may be called concurrently and does not change the offset of Read.
+func (m *memFile{{.Suffix}}) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("ReadAt: invalid offset")
+	}
+
+	if off >= m.size {
+		return 0, io.EOF
+	}
+
+	m.loadCache()
+	if m.cache != nil {
+		n := copy(p, (*m.cache)[off:])
+		if n < len(p) {
+			return n, io.EOF
 		}
+		return n, nil
 	}
+{{if .Codecs.stored}}
+	// A stored file is read directly from the data
+	if m.codec == codecStored{{.Suffix}} {
+		n, err := io.ReadFull(m.dataReader(off, m.length-off), p)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return n, err
+	}
+{{end}}
+	f := m.clone()
+	defer f.Close()
 
-	buf := make([]byte, offset - m.rOffset)
-	_, err := m.Read(buf)
-	return m.rOffset, err
+	if err := f.seek(off); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
 }
 
-func (m memFile) Stat() (os.FileInfo, error) {
+func (m memFile{{.Suffix}}) Stat() (os.FileInfo, error) {
 	return m, nil
 }
 
-func (m memFile) Name() string {
+func (m memFile{{.Suffix}}) Name() string {
 	return m.name
 }
 
-func (m memFile) Size() int64 {
+func (m memFile{{.Suffix}}) Size() int64 {
 	return m.size
 }
 
-func (m memFile) Mode() os.FileMode {
+func (m memFile{{.Suffix}}) Mode() os.FileMode {
 	return 0444
 }
 
-func (m memFile) ModTime() time.Time {
-	return m.modTime
+func (m memFile{{.Suffix}}) ModTime() time.Time {
+	return time.Unix(m.modTime, 0)
 }
 
-func (m memFile) IsDir() bool {
+func (m memFile{{.Suffix}}) IsDir() bool {
 	return false
 }
 
-func (m memFile) Sys() interface{} {
-	return nil
+// Sys returns the hex encoded SHA-256 hash of the file content.
+func (m memFile{{.Suffix}}) Sys() interface{} {
+	return m.hash
 }
 
 
-type memDir struct {
-	dir   string
-	files []os.FileInfo
-	size  int64
+type memDir{{.Suffix}} struct {
+	dir     string
+	files   []os.FileInfo
+	size    int64
+	modTime int64
+	mode    os.FileMode
 }
 
-func (m memDir) Close() error {
+func (m memDir{{.Suffix}}) Close() error {
 	return nil
 }
 
-func (m memDir) Read(p []byte) (n int, err error) {
+func (m memDir{{.Suffix}}) Read(p []byte) (n int, err error) {
 	return 0, errors.New("Read: invalid operation on directory")
 }
 
-func (m memDir) Seek(offset int64, whence int) (int64, error) {
+func (m memDir{{.Suffix}}) Seek(offset int64, whence int) (int64, error) {
 	return 0, errors.New("Seek: invalid operation on directory")
 }
 
-func (m *memDir) Readdir(count int) ([]os.FileInfo, error) {
+func (m *memDir{{.Suffix}}) Readdir(count int) ([]os.FileInfo, error) {
 	var ret []os.FileInfo
 
 	if count <= 0 || count >= len(m.files) {
@@ -181,45 +869,47 @@ func (m *memDir) Readdir(count int) ([]os.FileInfo, error) {
 	return ret, nil
 }
 
-func (m memDir) Stat() (os.FileInfo, error) {
+func (m memDir{{.Suffix}}) Stat() (os.FileInfo, error) {
 	return m, nil
 }
 
-func (m memDir) Name() string {
+func (m memDir{{.Suffix}}) Name() string {
 	if m.dir == "/" {
 		return "/"
 	}
 	return m.dir[strings.LastIndex(m.dir, "/")+1:]
 }
 
-func (m memDir) Size() int64 {
+func (m memDir{{.Suffix}}) Size() int64 {
 	return m.size
 }
 
-func (m memDir) Mode() os.FileMode {
-	return os.FileMode(0555)
+func (m memDir{{.Suffix}}) Mode() os.FileMode {
+	return os.ModeDir | m.mode
 }
 
-func (m memDir) ModTime() time.Time {
-	// Until now no directory information is stored
-	// in the asset data, so for now we return the current
-	// time.
-	return time.Now()
+// ModTime returns the modification time of the source directory, the time is
+// zero for directories without source directory like the parents of a mount.
+func (m memDir{{.Suffix}}) ModTime() time.Time {
+	if m.modTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(m.modTime, 0)
 }
 
-func (m memDir) IsDir() bool {
+func (m memDir{{.Suffix}}) IsDir() bool {
 	return true
 }
 
-func (m memDir) Sys() interface{} {
+func (m memDir{{.Suffix}}) Sys() interface{} {
 	return nil
 }
 
-type loader struct {
-	fm assetMap
+type loader{{.Suffix}} struct {
+	cache *vaultCache
 }
 
-func (l loader) Open(name string) (http.File, error) {
+func (l loader{{.Suffix}}) Open(name string) (http.File, error) {
 	if !strings.HasPrefix(name, "/") {
 		if name == "." {
 			name = ""
@@ -231,126 +921,421 @@ func (l loader) Open(name string) (http.File, error) {
 		name = strings.TrimRight(name, "/")
 	}
 
-	if v, ok := l.fm[name]; ok {
-		return &v, nil
+	if i := sort.SearchStrings(vaultFilePaths{{.Suffix}}[:], name); i < len(vaultFilePaths{{.Suffix}}) && vaultFilePaths{{.Suffix}}[i] == name {
+		return l.openFile(vaultFiles{{.Suffix}}[i]), nil
 	}
 
-	for _, v := range l.fm {
-		if strings.HasPrefix(v.path, name) {
-			return createDirFile(name, l.fm), nil
-		}
+	if d := findDir{{.Suffix}}(name); d != nil {
+		return d.open(), nil
 	}
 
 	return nil, os.ErrNotExist
 }
 
-// New{{.Suffix}}Loader returns a new AssetLoader for the {{.Suffix}} resources.
-func New{{.Suffix}}Loader() AssetLoader {
-	loader := &loader{
-		fm: assetMap{
-		{{- range  $el := .Files }}
-			"{{join $el.Path $el.Name}}": memFile{offset: {{$el.Offset}},
-				name: "{{$el.Name}}",
-				modTime: time.Unix({{$el.ModTime.Unix}}, 0),
-				path: "{{$el.Path}}",
-				size: {{$el.Size}},
-				length: {{$el.Length}},
-				},
-		{{- end}}
-		},
-	}
-	return loader
-}
-
-
-// assetMap holds all information about the embedded files
-type assetMap map[string]memFile
-
-// createDirFile creates a http.File for the given path.
-func createDirFile(path string, assets assetMap) http.File {
-	var fis []os.FileInfo
-	processed := map[string]struct{}{}
-
-	for _, val := range assets {
-		if val.path == path {
-			fis = append(fis, val)
-			continue
-		}
+// openFile returns the file, which looks up its content in the cache at the first
+// read if the cache policy caches it.
+func (l loader{{.Suffix}}) openFile(f memFile{{.Suffix}}) *memFile{{.Suffix}} {
+	if _, stored := f.content(); !stored && l.cache.caches(f.size) {
+		f.lookup, f.vc = new(sync.Once), l.cache
+	}
+	return &f
+}
 
-		if strings.HasPrefix(val.path, path) {
-			dir := strings.TrimPrefix(val.path, path)
-			dir = strings.TrimPrefix(dir, "/")
-			if n := strings.Index(dir, "/"); n >= 0 {
-				dir = dir[:n]
+// loadAll{{.Suffix}} adds the content of all compressed files to the cache.
+func loadAll{{.Suffix}}(c *vaultCache) {
+	for i, v := range vaultFiles{{.Suffix}} {
+		if _, stored := v.content(); !stored {
+			if data, err := readAll{{.Suffix}}(v); err == nil {
+				c.add(vaultFilePaths{{.Suffix}}[i], data)
 			}
+		}
+	}
+}
 
-			if _, ok := processed[dir]; !ok {
-				var prefix string
-				if path == "/" {
-					prefix = "/" + dir
-				} else {
-					prefix = fmt.Sprintf("%v/%v", path, dir)
-				}
+// readAll{{.Suffix}} returns the verified content of the file.
+func readAll{{.Suffix}}(f memFile{{.Suffix}}) (string, error) {
+	defer f.Close()
 
-				fis = append(fis, memDir{dir: dir, size: getSize(prefix, assets)})
-				processed[dir] = struct{}{}
-			}
-		}
+	var b strings.Builder
+	b.Grow(int(f.size))
+	_, err := io.Copy(&b, &f)
+	return b.String(), err
+}
+
+func (l *loader{{.Suffix}}) CacheStats() CacheStats {
+	return l.cache.statistics()
+}
+
+func (l *loader{{.Suffix}}) FS() fs.FS {
+	return vaultFS{l: l, dir: "."}
+}
+
+func (l *loader{{.Suffix}}) ReadFile(name string) ([]byte, error) {
+	return vaultReadFile(l, name)
+}
+
+// ReadString returns the content of a stored file without copying, the content
+// is not verified in this case.
+func (l *loader{{.Suffix}}) ReadString(name string) (string, error) {
+	f, err := l.Open(name)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	sort.Slice(fis, func(i, j int) bool {
-		switch {
-		case fis[i].IsDir() && !fis[j].IsDir():
-			return true
-		case !fis[i].IsDir() && fis[j].IsDir():
-			return false
-		default:
-			return fis[i].Name() < fis[j].Name()
-		}
-	})
+	mf, ok := f.(*memFile{{.Suffix}})
+	if !ok {
+		return "", fmt.Errorf("ReadString: '%v' is a directory", name)
+	}
 
-	return &memDir{dir: path, size: getSize(path, assets), files: fis}
+	if s, ok := mf.content(); ok {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(int(mf.size))
+	_, err = io.Copy(&b, mf)
+	return b.String(), err
 }
 
-// getSize summarize all files under the given path.
-func getSize(path string, assets assetMap) int64 {
-	var cnt int64
-	for _, item := range assets {
-		if strings.HasPrefix(item.path, path) {
-			cnt += item.size
-		}
+func (l *loader{{.Suffix}}) MustReadFile(name string) []byte {
+	return vaultMustReadFile(l, name)
+}
+
+func (l *loader{{.Suffix}}) Exists(name string) bool {
+	return vaultExists(l, name)
+}
+
+func (l *loader{{.Suffix}}) Names() []string {
+	names := make([]string, len(vaultFilePaths{{.Suffix}}))
+	copy(names, vaultFilePaths{{.Suffix}}[:])
+	return names
+}
+
+func (l *loader{{.Suffix}}) Walk(root string, fn fs.WalkDirFunc) error {
+	return vaultWalk(l, root, fn)
+}
+
+func (l loader{{.Suffix}}) Hash(name string) (string, error) {
+	f, err := l.Open(name)
+	if err != nil {
+		return "", err
+	}
+
+	mf, ok := f.(*memFile{{.Suffix}})
+	if !ok {
+		return "", fmt.Errorf("Hash: '%v' is a directory", name)
+	}
+	return mf.hash, nil
+}
+
+// New{{.Suffix}}Loader returns a new AssetLoader for the {{.Suffix}} resources.
+func New{{.Suffix}}Loader(options ...LoaderOption) AssetLoader {
+	return &loader{{.Suffix}}{cache: newVaultCache(options)}
+}
+
+// The files and directories of the vault are declared once, the arrays contain only
+// constants, so the compiler lays them out statically and the loader does not build
+// them at run time.
+
+// vaultFilePaths{{.Suffix}} contains the paths of all files sorted, the file with
+// the path at index i is vaultFiles{{.Suffix}}[i].
+var vaultFilePaths{{.Suffix}} = [...]string{
+{{- range $el := .Files}}
+	"{{join $el.Path $el.Name}}",
+{{- end}}
+}
+
+var vaultFiles{{.Suffix}} = [...]memFile{{.Suffix}}{
+{{- range $el := .Files}}
+	{offset: {{$el.Offset}},
+		name: "{{$el.Name}}",
+		modTime: {{$el.ModTime.Unix}},
+		path: "{{$el.Path}}",
+		size: {{$el.Size}},
+		length: {{$el.Length}},
+		shard: {{$el.Shard}},
+		codec: codec{{title $el.Codec.String}}{{$.Suffix}},
+		hash: "{{$el.Hash}}",
+	{{- if $el.Blocks}}
+		blockSize: {{$el.BlockSize}},
+		blocks: []int64{ {{- range $i, $b := $el.Blocks}}{{if $i}}, {{end}}{{$b}}{{end -}} },
+	{{- end}}
+	},
+{{- end}}
+}
+
+// dirIndex{{.Suffix}} is a directory of the vault, the subdirectories and files
+// are indices into vaultDirs{{.Suffix}} and vaultFiles{{.Suffix}} sorted by name.
+type dirIndex{{.Suffix}} struct {
+	path    string
+	size    int64
+	modTime int64
+	mode    os.FileMode
+	dirs    []int
+	files   []int
+}
+
+// vaultDirs{{.Suffix}} contains all directories sorted by path.
+var vaultDirs{{.Suffix}} = [...]dirIndex{{.Suffix}}{
+{{- range $el := .Dirs}}
+	{path: "{{$el.Path}}", size: {{$el.Size}}, modTime: {{if $el.ModTime.IsZero}}0{{else}}{{$el.ModTime.Unix}}{{end}}, mode: {{printf "%#o" $el.Mode}}
+	{{- if $el.Dirs}}, dirs: []int{ {{- range $i, $d := $el.Dirs}}{{if $i}}, {{end}}{{$d}}{{end -}} }{{end}}
+	{{- if $el.Files}}, files: []int{ {{- range $i, $f := $el.Files}}{{if $i}}, {{end}}{{$f}}{{end -}} }{{end -}}
+	},
+{{- end}}
+}
+
+// findDir{{.Suffix}} returns the directory with the given path, nil if it does not exist.
+func findDir{{.Suffix}}(path string) *dirIndex{{.Suffix}} {
+	i := sort.Search(len(vaultDirs{{.Suffix}}), func(i int) bool { return vaultDirs{{.Suffix}}[i].path >= path })
+	if i < len(vaultDirs{{.Suffix}}) && vaultDirs{{.Suffix}}[i].path == path {
+		return &vaultDirs{{.Suffix}}[i]
+	}
+	return nil
+}
+
+// open returns a http.File listing the subdirectories first, then the files.
+func (d *dirIndex{{.Suffix}}) open() http.File {
+	fis := make([]os.FileInfo, 0, len(d.dirs)+len(d.files))
+	for _, i := range d.dirs {
+		fis = append(fis, vaultDirs{{.Suffix}}[i].info())
+	}
+	for _, i := range d.files {
+		fis = append(fis, vaultFiles{{.Suffix}}[i])
 	}
-	return cnt
+
+	dir := d.info()
+	dir.files = fis
+	return &dir
+}
+
+// info returns the directory without entries.
+func (d *dirIndex{{.Suffix}}) info() memDir{{.Suffix}} {
+	return memDir{{.Suffix}}{dir: d.path, size: d.size, modTime: d.modTime, mode: d.mode}
 }
 `
 
 const debugFileTemp = `
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"time"
 	"net/http"
 )
 
-type debugLoader struct {
-	base string
+type debugMount{{.Suffix}} struct {
+	prefix, base string
+}
+
+type debugLoader{{.Suffix}} struct {
+	// mounts are sorted by the length of the prefix, longest first
+	mounts []debugMount{{.Suffix}}
+}
+
+func (d debugLoader{{.Suffix}}) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, m := range d.mounts {
+		if m.prefix == "/" {
+			return os.Open(getFullPath{{.Suffix}}(m.base, name))
+		}
+
+		if name == m.prefix || strings.HasPrefix(name, m.prefix+"/") {
+			return os.Open(getFullPath{{.Suffix}}(m.base, strings.TrimPrefix(name, m.prefix)))
+		}
+	}
+
+	// Parent directories of mount points only exist in the vault
+	dir := &mountDir{{.Suffix}}{name: name}
+	for _, m := range d.mounts {
+		if !strings.HasPrefix(m.prefix, strings.TrimSuffix(name, "/")+"/") {
+			continue
+		}
+
+		child := strings.TrimPrefix(m.prefix, strings.TrimSuffix(name, "/")+"/")
+		if n := strings.Index(child, "/"); n >= 0 {
+			child = child[:n]
+		}
+		dir.add(child)
+	}
+
+	if len(dir.files) == 0 {
+		return nil, os.ErrNotExist
+	}
+	sort.Slice(dir.files, func(i, j int) bool { return dir.files[i].Name() < dir.files[j].Name() })
+	return dir, nil
+}
+
+// Hash computes the hash of the file on every call.
+func (d debugLoader{{.Suffix}}) Hash(name string) (string, error) {
+	f, err := d.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil {
+		return "", err
+	} else if fi.IsDir() {
+		return "", fmt.Errorf("Hash: '%v' is a directory", name)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (d *debugLoader{{.Suffix}}) FS() fs.FS {
+	return vaultFS{l: d, dir: "."}
+}
+
+func (d *debugLoader{{.Suffix}}) ReadFile(name string) ([]byte, error) {
+	return vaultReadFile(d, name)
+}
+
+// CacheStats returns no counters, the debug loader never caches.
+func (d *debugLoader{{.Suffix}}) CacheStats() CacheStats {
+	return CacheStats{}
+}
+
+func (d *debugLoader{{.Suffix}}) ReadString(name string) (string, error) {
+	data, err := d.ReadFile(name)
+	return string(data), err
+}
+
+func (d *debugLoader{{.Suffix}}) MustReadFile(name string) []byte {
+	return vaultMustReadFile(d, name)
 }
 
-func (d debugLoader) Open(name string) (http.File, error) {
-	return os.Open(getFullPath(d.base, name))
+func (d *debugLoader{{.Suffix}}) Exists(name string) bool {
+	return vaultExists(d, name)
 }
 
-func getFullPath(b, p string) string {
+// Names walks the source directories on every call.
+func (d *debugLoader{{.Suffix}}) Names() []string {
+	var names []string
+	d.Walk("/", func(name string, e fs.DirEntry, err error) error {
+		if err == nil && !e.IsDir() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names
+}
+
+func (d *debugLoader{{.Suffix}}) Walk(root string, fn fs.WalkDirFunc) error {
+	return vaultWalk(d, root, fn)
+}
+
+func getFullPath{{.Suffix}}(b, p string) string {
 	return path.Clean(fmt.Sprintf("%v/%v", b, path.Clean("/"+p)))
 }
 
+// mountDir{{.Suffix}} is a directory containing mount points.
+type mountDir{{.Suffix}} struct {
+	name  string
+	files []os.FileInfo
+}
+
+func (m *mountDir{{.Suffix}}) add(name string) {
+	for _, fi := range m.files {
+		if fi.Name() == name {
+			return
+		}
+	}
+	m.files = append(m.files, &mountDir{{.Suffix}}{name: name})
+}
+
+func (m mountDir{{.Suffix}}) Close() error {
+	return nil
+}
+
+func (m mountDir{{.Suffix}}) Read(p []byte) (n int, err error) {
+	return 0, errors.New("Read: invalid operation on directory")
+}
+
+func (m mountDir{{.Suffix}}) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("Seek: invalid operation on directory")
+}
+
+func (m *mountDir{{.Suffix}}) Readdir(count int) ([]os.FileInfo, error) {
+	var ret []os.FileInfo
+
+	if count <= 0 || count >= len(m.files) {
+		ret = m.files[:]
+		m.files = m.files[0:0]
+	} else {
+		ret = m.files[:count]
+		m.files = m.files[count:]
+	}
+
+	if count > 0 && len(m.files) == 0 {
+		return ret, io.EOF
+	}
+	return ret, nil
+}
+
+func (m mountDir{{.Suffix}}) Stat() (os.FileInfo, error) {
+	return m, nil
+}
+
+func (m mountDir{{.Suffix}}) Name() string {
+	if m.name == "/" {
+		return "/"
+	}
+	return m.name[strings.LastIndex(m.name, "/")+1:]
+}
+
+func (m mountDir{{.Suffix}}) Size() int64 {
+	return 0
+}
+
+func (m mountDir{{.Suffix}}) Mode() os.FileMode {
+	return os.ModeDir | 0555
+}
+
+func (m mountDir{{.Suffix}}) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (m mountDir{{.Suffix}}) IsDir() bool {
+	return true
+}
+
+func (m mountDir{{.Suffix}}) Sys() interface{} {
+	return nil
+}
+
 // New{{.Suffix}}Loader returns a new AssetLoader for the {{.Suffix}} resources.
-func New{{.Suffix}}Loader() AssetLoader {
-	return &debugLoader{base: "{{.Base}}"}
+// The options are ignored, the debug loader always reads the files from disk.
+func New{{.Suffix}}Loader(options ...LoaderOption) AssetLoader {
+	return &debugLoader{{.Suffix}}{mounts: []debugMount{{.Suffix}}{
+	{{- range $m := .Mounts }}
+		{prefix: "{{$m.Prefix}}", base: "{{$m.Base}}"},
+	{{- end}}
+	}}
 }
 
 `
 
+const shardImportTempl = `
+{{- if eq . "base64"}}
+import "encoding/base64"
+{{- else if eq . "asm"}}
+import "unsafe"
+{{- end}}
+`
+
 const fileHeaderTempl = `// This file is generated by the vault-cli command line utility.
 // It offers a easy way to embed binary resources into a go executable.
 // DO NOT EDIT this file, it will be overwritten on the next run of the vault-cli utility.
@@ -1,3 +1,5 @@
 module github.com/go-sharp/vault/vault-cli
 
+go 1.16
+
 require github.com/go-sharp/vault/v2 v2.0.0
@@ -5,10 +5,17 @@
 
 package main // "github.com/go-sharp/vault/vault-cli"
 import (
+	"compress/flate"
+	"context"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	vault "github.com/go-sharp/vault/v2"
 )
@@ -26,23 +33,48 @@ func (a *arrayFlag) Set(s string) error {
 
 func main() {
 	// Flag declarations
-	var relpath, name, pkgName string
-	var subdirs, nocomp bool
-	var incl, excl arrayFlag
+	var relpath, name, pkgName, codec, mtime, encoding, tag string
+	var subdirs, emptyDirs, nocomp, force, compressAll, glob, ignoreFiles, followLinks, linkAliases, sourceEpoch, noDebug bool
+	var minSavings float64
+	var shardSize, blockSize, maxSize int64
+	var workers, level int
+	var incl, excl, mounts, fileCodecs arrayFlag
 
 	flag.StringVar(&relpath, "rp", "", "Set relative path from the executing binary "+
 		"to the source directory (for debug use only)")
 	flag.StringVar(&name, "n", "", "Set the name of the embedded resources (default: source folder name)")
 	flag.StringVar(&pkgName, "p", "", "Set the package name for the generated files (default: destination folder name)")
 	flag.BoolVar(&subdirs, "s", false, "Include files in subdirectories")
+	flag.BoolVar(&emptyDirs, "empty-dirs", false, "Include directories without files into the vault")
 	flag.BoolVar(&nocomp, "no-comp", false, "Do not compress files")
-	flag.Var(&incl, "i", "Set files to include into the generated resource file (a list with regexp)")
-	flag.Var(&excl, "e", "Set files to exclude from the generated resource file (a list with regexp)")
+	flag.StringVar(&codec, "codec", "zlib", "Set the codec to compress files (stored, zlib, deflate, gzip or lzw)")
+	flag.Var(&fileCodecs, "codec-for", "Set the codec for files matching a pattern, format: codec=pattern (can be repeated)")
+	flag.IntVar(&level, "level", flate.BestCompression, "Set the compression level (-2 to 9)")
+	flag.Float64Var(&minSavings, "min-savings", 0.05, "Store files uncompressed if compression saves less than this ratio")
+	flag.BoolVar(&compressAll, "compress-all", false, "Compress files with an already compressed format (ex. jpeg, png, zip)")
+	flag.StringVar(&encoding, "encoding", "escaped", "Set the encoding of the data in the release file (escaped, raw, base64 or asm)")
+	flag.Int64Var(&shardSize, "shard-size", 0, "Split the data into shard files not exceeding this size in bytes (min. 65536, 0 disables sharding)")
+	flag.Int64Var(&blockSize, "block-size", 64*1024, "Compress files in independent blocks of this size in bytes for fast seeking (0 compresses every file as one block)")
+	flag.Int64Var(&maxSize, "max-size", 0, "Fail if a file is larger than this size in bytes (0 means no limit)")
+	flag.StringVar(&tag, "tag", "debug", "Set the build tag or constraint expression selecting the debug loader (ex. \"vaultdev\")")
+	flag.BoolVar(&noDebug, "no-debug", false, "Do not generate the debug file, the release files are built without build constraint")
+	flag.BoolVar(&force, "f", false, "Generate the vault even if it is up to date")
+	flag.IntVar(&workers, "j", runtime.NumCPU(), "Set the number of files compressed concurrently")
+	flag.Var(&incl, "i", "Set files to include into the generated resource file (a list with regexp, gitignore-style globs with -glob)")
+	flag.Var(&excl, "e", "Set files to exclude from the generated resource file (a list with regexp, gitignore-style globs with -glob)")
+	flag.BoolVar(&ignoreFiles, "ignore-files", false, "Skip files ignored by .gitignore and .vaultignore files in the source tree")
+	flag.BoolVar(&followLinks, "L", false, "Follow symlinks to files and directories")
+	flag.BoolVar(&linkAliases, "link-aliases", false, "Follow symlinks and store files reached through a symlink as alias of the target")
+	flag.BoolVar(&glob, "glob", false, "Interpret include, exclude and codec patterns as gitignore-style globs")
+	flag.StringVar(&mtime, "mtime", "", "Set the modification time of all files, format: unix timestamp or RFC 3339")
+	flag.BoolVar(&sourceEpoch, "source-date-epoch", false, "Set the modification time of all files to SOURCE_DATE_EPOCH if set")
+	flag.Var(&mounts, "m", "Mount a directory at a prefix into the vault, format: prefix=dir (can be repeated)")
 
 	flag.Usage = func() {
 		fmt.Printf("vault-cli V%v © The Vault Authors\n\n", vault.Version)
 		fmt.Println("Usage of vault-cli:")
 		fmt.Println("vault-cli [options] source destination")
+		fmt.Println("vault-cli [options] -m prefix=dir [-m prefix=dir ...] [source] destination")
 		flag.PrintDefaults()
 	}
 
@@ -50,19 +82,114 @@ func main() {
 	src := flag.Arg(0)
 	dst := flag.Arg(1)
 
-	if src == "" || dst == "" {
+	// The source directory is optional if directories are mounted
+	if len(mounts) > 0 && flag.NArg() == 1 {
+		src, dst = "", flag.Arg(0)
+	}
+
+	if (src == "" && len(mounts) == 0) || dst == "" {
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	generator := vault.NewGenerator(src, dst,
+	defaultCodec, err := vault.ParseCodec(codec)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	enc, err := vault.ParseEncoding(encoding)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	syntax := vault.RegexpSyntax
+	if glob {
+		syntax = vault.GlobSyntax
+	}
+
+	options := []vault.GeneratorOption{
+		vault.PatternSyntaxOption(syntax),
 		vault.RelativePathOption(relpath),
 		vault.PackageNameOption(pkgName),
 		vault.ResourceNameOption(name),
 		vault.WithSubdirsOption(subdirs),
+		vault.EmptyDirsOption(emptyDirs),
+		vault.IgnoreFilesOption(ignoreFiles),
+		vault.FollowSymlinksOption(followLinks),
+		vault.SymlinkAliasesOption(linkAliases),
 		vault.CompressOption(!nocomp),
+		vault.CodecOption(defaultCodec),
+		vault.CompressionLevelOption(level),
+		vault.MinSavingsOption(minSavings),
+		vault.SkipCompressedFormatsOption(!compressAll),
+		vault.EncodingOption(enc),
+		vault.ShardSizeOption(shardSize),
+		vault.BlockSizeOption(blockSize),
+		vault.MaxFileSizeOption(maxSize),
+		vault.BuildTagOption(tag),
+		vault.DebugFileOption(!noDebug),
+		vault.WorkersOption(workers),
+		vault.ForceOption(force),
+		vault.SourceDateEpochOption(sourceEpoch),
 		vault.IncludeFilesOption(incl...),
-		vault.ExcludeFilesOption(excl...))
+		vault.ExcludeFilesOption(excl...),
+	}
+
+	if mtime != "" {
+		t, err := parseTime(mtime)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		options = append(options, vault.ModTimeOption(t))
+	}
+
+	for _, m := range mounts {
+		idx := strings.Index(m, "=")
+		if idx == -1 {
+			log.Fatalf("invalid mount '%v': expected format prefix=dir\n", m)
+		}
+		options = append(options, vault.MountOption(m[:idx], m[idx+1:]))
+	}
+
+	for _, fc := range fileCodecs {
+		idx := strings.Index(fc, "=")
+		if idx == -1 {
+			log.Fatalf("invalid file codec '%v': expected format codec=pattern\n", fc)
+		}
 
-	generator.Run()
+		c, err := vault.ParseCodec(fc[:idx])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		options = append(options, vault.FileCodecOption(c, fc[idx+1:]))
+	}
+
+	generator, err := vault.NewGenerator(src, dst, options...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := generator.Run(ctx); err != nil {
+		log.Fatalln(err)
+	}
+
+	if generator.Report().UpToDate {
+		fmt.Println("up to date")
+	}
+}
+
+// parseTime parses a unix timestamp or a RFC 3339 formatted time.
+func parseTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid modification time '%v': expected unix timestamp or RFC 3339", s)
+	}
+	return t, nil
 }
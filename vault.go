@@ -8,7 +8,12 @@ package vault
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"go/build/constraint"
 	"go/format"
 	"io"
 	"io/ioutil"
@@ -16,7 +21,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -24,25 +31,31 @@ import (
 
 const (
 	// Version is the current vault version.
-	Version            = "2.0.0"
-	ttSharedTypesTempl = "sharedTypes"
-	ttDebugFileTempl   = "debugFile"
-	ttReleaseFileTempl = "releaseFile"
-	ttFileHeaderTempl  = "fileHeaderTempl"
+	Version              = "2.0.0"
+	ttSharedTypesTempl   = "sharedTypes"
+	ttDebugFileTempl     = "debugFile"
+	ttReleaseFileTempl   = "releaseFile"
+	ttReleaseImportTempl = "releaseImport"
+	ttFileHeaderTempl    = "fileHeaderTempl"
+	ttShardImportTempl   = "shardImport"
+	// streamSize is the size of the largest file kept in memory during the generation
+	streamSize = 4 * 1024 * 1024
+	// defaultBlockSize is the default number of uncompressed bytes compressed as one block
+	defaultBlockSize = 64 * 1024
 )
 
 var ttRepo *template.Template
 
-func execTempl(w io.Writer, name string, data interface{}) {
+func execTempl(w io.Writer, name string, data interface{}) error {
 	if err := ttRepo.ExecuteTemplate(w, name, data); err != nil {
-		log.Fatalf("failed to execute templ '%v': %v\n", name, err)
+		return fmt.Errorf("failed to execute templ '%v': %w", name, err)
 	}
+	return nil
 }
 
-func fprintf(w io.Writer, format string, a ...interface{}) {
-	if _, err := fmt.Fprintf(w, format, a...); err != nil {
-		log.Fatalln("failed to write: ", err)
-	}
+func fprintf(w io.Writer, format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(w, format, a...)
+	return err
 }
 
 func init() {
@@ -50,287 +63,767 @@ func init() {
 		"join": func(s ...string) string {
 			return path.Clean(strings.Join(s, "/"))
 		},
+		"title": strings.Title,
+		"codec": ParseCodec,
 	})
 	ttRepo = template.Must(ttRepo.New(ttDebugFileTempl).Parse(debugFileTemp))
 	ttRepo = template.Must(ttRepo.New(ttSharedTypesTempl).Parse(sharedTypesTempl))
 	ttRepo = template.Must(ttRepo.New(ttReleaseFileTempl).Parse(releaseFileTempl))
+	ttRepo = template.Must(ttRepo.New(ttReleaseImportTempl).Parse(releaseImportTempl))
 	ttRepo = template.Must(ttRepo.New(ttFileHeaderTempl).Parse(fileHeaderTempl))
+	ttRepo = template.Must(ttRepo.New(ttShardImportTempl).Parse(shardImportTempl))
 
 }
 
-type patterns []string
+// Generator creates a vault with embedded files.
+type Generator struct {
+	config       GeneratorConfig
+	sharedFile   string
+	debugFile    string
+	releaseFile  string
+	asmFile      string
+	manifestFile string
+	report       Report
+	// dataFiles contains the assembly and shard files written by the last run
+	dataFiles []string
+}
 
-func (p patterns) matches(s string) bool {
-	var ok bool
-	var err error
-	for _, pat := range p {
-		ok, err = regexp.MatchString(pat, s)
+// Report summarizes a run of the generator.
+type Report struct {
+	// UpToDate is true if the vault was up to date and no file was written.
+	UpToDate bool
+	// Files is the number of files in the vault.
+	Files int
+	// DataSizes contains for every encoding the size in bytes of the data
+	// declaration in the release file. It is only set if the vault was generated.
+	DataSizes map[Encoding]int64
+}
+
+// Run starts the vault generation. The generation stops as soon as
+// the context is cancelled or an error occurs. If the source files and
+// the configuration did not change since the last run, no file is written.
+func (g *Generator) Run(ctx context.Context) error {
+	log.Println("starting vault generation...")
+	g.report = Report{}
+	if err := os.MkdirAll(g.config.dest, 0700); err != nil {
+		return &WriteError{File: g.config.dest, Err: err}
+	}
+
+	items, dirs, err := walkSrcDirectory(ctx, g.config)
+	if err != nil {
+		return err
+	}
+	g.report.Files = len(items)
+
+	if !g.config.force {
+		ok, err := g.upToDate(ctx, items, dirs)
 		if err != nil {
-			log.Println("ERROR: ", err)
-			continue
+			return err
 		}
 
 		if ok {
-			return true
+			log.Printf("vault '%v' is up to date...\n", g.config.name)
+			g.report.UpToDate = true
+			return nil
+		}
+	}
+
+	// Create shared and debug files, the shared file is the same for all vaults of the package
+	err = g.createStaticFile(g.sharedFile,
+		func(w io.Writer) error { return execTempl(w, ttFileHeaderTempl, g.config.pkgName) },
+		func(w io.Writer) error { return execTempl(w, ttSharedTypesTempl, nil) })
+	if err != nil {
+		return err
+	}
+
+	// Older versions wrote the shared types per vault, they would be declared twice
+	legacy := fmt.Sprintf("%v/shared_%v_vault.go", g.config.dest, g.config.name)
+	if err := os.Remove(legacy); err != nil && !os.IsNotExist(err) {
+		return &WriteError{File: legacy, Err: err}
+	}
+
+	// The debug loader reads the primary source directory from the relative path
+	var mounts []map[string]string
+	for _, m := range g.config.mounts {
+		base := m.src
+		if m.primary && g.config.relPath != "" {
+			base = g.config.relPath
 		}
+		mounts = append(mounts, map[string]string{"Prefix": m.prefix, "Base": base})
+	}
+	sort.SliceStable(mounts, func(i, j int) bool { return len(mounts[i]["Prefix"]) > len(mounts[j]["Prefix"]) })
+
+	if g.config.debugFile {
+		err = g.createStaticFile(g.debugFile,
+			func(w io.Writer) error { return fprintf(w, "%v", g.config.buildConstraint(true)) },
+			func(w io.Writer) error { return execTempl(w, ttFileHeaderTempl, g.config.pkgName) },
+			func(w io.Writer) error {
+				return execTempl(w, ttDebugFileTempl, map[string]interface{}{
+					"Suffix": strings.Title(g.config.name),
+					"Mounts": mounts,
+				})
+			})
+	} else if err = os.Remove(g.debugFile); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	files, err := g.createVault(ctx, items, dirs)
+	if err != nil {
+		return err
 	}
 
-	return false
+	return g.writeManifest(dirs, files)
 }
 
-// Generator creates a vault with embedded files.
-type Generator struct {
-	config      GeneratorConfig
-	sharedFile  string
-	debugFile   string
-	releaseFile string
+// Report returns the report of the last run.
+func (g *Generator) Report() Report {
+	return g.report
 }
 
-// Run starts the vault generation, calls log.Fatal if an error occurs.
-func (g *Generator) Run() {
-	log.Println("starting vault generation...")
-	if err := os.MkdirAll(g.config.dest, 0700); err != nil {
-		log.Fatalln("failed to create destination folder: ", err)
+func (g *Generator) createVault(ctx context.Context, items []fileItem, dirs []dirItem) ([]fileModel, error) {
+	// Write into a temporary file first, so an unchanged vault
+	// or a failed run leaves the existing release file untouched.
+	tmpFile := g.releaseFile + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, &WriteError{File: tmpFile, Err: err}
 	}
+	defer os.Remove(tmpFile)
 
-	// Create shared and debug files
-	g.createStaticFile(g.sharedFile,
-		func(w io.Writer) { execTempl(w, ttFileHeaderTempl, g.config.pkgName) },
-		func(w io.Writer) { execTempl(w, ttSharedTypesTempl, nil) })
+	w := fileWriter{name: g.releaseFile, w: file}
+	sw := &shardWriter{g: g, assetName: strings.Title(g.config.name), w: w}
+	defer sw.cleanup()
 
-	basePath := g.config.src
-	if g.config.relPath != "" {
-		basePath = g.config.relPath
+	files, err := g.writeVault(ctx, w, sw, items, dirs)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = &WriteError{File: g.releaseFile, Err: cerr}
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	g.createStaticFile(g.debugFile,
-		func(w io.Writer) { fprintf(w, "// +build debug\n\n") },
-		func(w io.Writer) { execTempl(w, ttFileHeaderTempl, g.config.pkgName) },
-		func(w io.Writer) {
-			execTempl(w, ttDebugFileTempl, map[string]string{
-				"Suffix": strings.Title(g.config.name),
-				"Base":   basePath,
-			})
-		})
+	// Data files are replaced first, so the release file never references missing data
+	if err := sw.commit(); err != nil {
+		return nil, err
+	}
+	g.dataFiles = sw.dataFiles()
 
-	g.createVault(walkSrcDirectory(g.config))
+	return files, replaceFile(tmpFile, g.releaseFile)
 }
 
-func (g *Generator) createVault(ch <-chan fileItem) {
-	file, err := os.OpenFile(g.releaseFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
-	if err != nil {
-		log.Fatalln(err)
+func (g *Generator) writeVault(ctx context.Context, w io.Writer, sw *shardWriter, items []fileItem, dirs []dirItem) ([]fileModel, error) {
+	// Write build constraint
+	if err := fprintf(w, "%v", g.config.buildConstraint(false)); err != nil {
+		return nil, err
 	}
-
-	// Write build tags
-	fprintf(file, "// +build !debug\n\n")
 	// Execute header template
-	execTempl(file, ttFileHeaderTempl, g.config.pkgName)
-	// Write imports
-	fprintf(file, releaseImportTempl)
+	if err := execTempl(w, ttFileHeaderTempl, g.config.pkgName); err != nil {
+		return nil, err
+	}
+	// Write imports, files not worth compressing may be stored uncompressed
+	codecs := map[string]bool{StoredCodec.String(): true}
+	for _, item := range items {
+		codec, _ := g.config.codecFor(item.path)
+		codecs[codec.String()] = true
+	}
+
+	// Shards contain their own imports
+	encoding := g.config.encoding.String()
+	if g.config.shardSize > 0 {
+		encoding = ""
+	}
+
+	err := execTempl(w, ttReleaseImportTempl, map[string]interface{}{
+		"Codecs":   codecs,
+		"Encoding": encoding,
+	})
+	if err != nil {
+		return nil, err
+	}
 	// Write binary data
-	var files = processFiles(strings.Title(g.config.name), g.config.cmpLvl, file, ch)
+	g.report.DataSizes = map[Encoding]int64{}
+	files, err := processFiles(ctx, strings.Title(g.config.name), g.config, sw, items, g.report.DataSizes)
+	if err != nil {
+		return nil, err
+	}
+
+	var sizes []string
+	for i := range encodingNames {
+		sizes = append(sizes, fmt.Sprintf("%v=%v", Encoding(i), g.report.DataSizes[Encoding(i)]))
+	}
+	log.Printf("size of data in bytes per encoding: %v (using %v)\n", strings.Join(sizes, ", "), g.config.encoding)
 	// Write release file template
-	execTempl(file, ttReleaseFileTempl, map[string]interface{}{
+	return files, execTempl(w, ttReleaseFileTempl, map[string]interface{}{
 		"Suffix": strings.Title(g.config.name),
 		"Files":  files,
+		"Dirs":   buildDirIndex(g.config, files, dirs),
+		"Codecs": codecs,
+		"Shards": sw.names,
 	})
-
-	if err := file.Close(); err != nil {
-		log.Fatalf("failed to close file: %v", err)
-	}
 }
 
-func processFiles(assetName string, cmpLvl int, w io.Writer, ch <-chan fileItem) []fileModel {
+// processFiles writes the data of all files with the shard writer and stores the
+// size of the unsharded data declaration for every encoding in sizes.
+func processFiles(ctx context.Context, assetName string, cfg GeneratorConfig, sw *shardWriter,
+	items []fileItem, sizes map[Encoding]int64) ([]fileModel, error) {
 	var files []fileModel
-	var offset int64
 
-	fprintf(w, "\nvar vaultAssetBin%v = \"", assetName)
+	// Stop the workers if writing the vault fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	for f := range ch {
-		log.Printf("processing file '%v'...\n", f.fullpath)
-		of, err := os.Open(f.fullpath)
-		if err != nil {
-			log.Fatalf("failed to read file: %v\n", err)
-		}
+	queue := compressFiles(ctx, cfg, items)
 
-		// create a binary to string literal writer
-		sw := &binToStrWriter{w: w}
-		zw, err := zlib.NewWriterLevel(sw, cmpLvl)
-		if err != nil {
-			log.Fatalf("failed to create zlib writer: %v\n", err)
+	if err := sw.open(); err != nil {
+		return nil, err
+	}
+
+	// The sizes of the other encodings are computed from byte counts
+	counter := &sizeCounter{assetName: assetName}
+
+	// Results are queued in the same order as the walker returned the files,
+	// so the output is independent of the number of workers.
+	for res := range queue {
+		r := <-res
+		if r.err != nil {
+			return nil, r.err
 		}
 
-		// read source file into byte slice
-		b, err := ioutil.ReadAll(of)
-		if err != nil {
-			log.Fatalf("failed to read file '%v': %v", f.fullpath, err)
+		// Aliases share the data of their target, which may follow the alias
+		if r.item.alias {
+			files = append(files, fileModel{})
+			continue
 		}
 
-		// write and close the zlib writer
-		_, err = zw.Write(b)
+		var err error
+		dw := &dataWriter{sw: sw, counter: counter}
+		if r.stream {
+			err = streamFile(cfg, &r, dw)
+		} else {
+			_, err = dw.Write(r.data)
+		}
 		if err != nil {
-			log.Fatalf("failed to write to zlib writer: %v", err)
+			return nil, err
 		}
 
-		if err = zw.Close(); err != nil {
-			log.Fatalf("failed to close zlib writer: %v\n", err)
+		fm := fileModel{
+			Name:    r.item.fi.Name(),
+			Path:    getPath(r.item.path),
+			Size:    r.item.fi.Size(),
+			ModTime: cfg.modTimeOf(r.item.fi),
+			Shard:   dw.shard,
+			Offset:  dw.offset,
+			Length:  dw.length,
+			Hash:    r.hash,
+			Codec:   r.codec,
+			Blocks:  r.blocks,
+		}
+		if len(r.blocks) > 0 {
+			fm.BlockSize = cfg.blockSize
 		}
+		files = append(files, fm)
+	}
 
-		files = append(files, fileModel{
-			Name:    f.fi.Name(),
-			Path:    getPath(f.path),
-			Size:    f.fi.Size(),
-			ModTime: f.fi.ModTime(),
-			Offset:  offset,
-			Length:  sw.length,
-		})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-		offset += sw.length
+	for i, item := range items {
+		if item.alias {
+			fm := files[item.target]
+			fm.Name = item.fi.Name()
+			fm.Path = getPath(item.path)
+			fm.ModTime = cfg.modTimeOf(item.fi)
+			files[i] = fm
+		}
 	}
 
-	fprintf(w, "\"\n")
-	return files
-}
+	if err := sw.close(); err != nil {
+		return nil, err
+	}
 
-func getPath(p string) string {
-	idx := strings.LastIndex(p, "/")
-	if idx <= 0 {
-		return "/"
+	for i := range encodingNames {
+		sizes[Encoding(i)] = counter.size(Encoding(i))
 	}
+	return files, nil
+}
 
-	return path.Clean("/" + p[:idx])
+type compressJob struct {
+	item fileItem
+	res  chan<- compressResult
+}
+
+type compressResult struct {
+	item  fileItem
+	codec Codec
+	data  []byte
+	hash  string
+	// blocks contains the end offsets of the compressed blocks, nil for a single block
+	blocks []int64
+	// stream is set if the file is too large to keep its data in memory
+	stream bool
+	err    error
 }
 
-func walkSrcDirectory(cfg GeneratorConfig) <-chan fileItem {
-	ch := make(chan fileItem, 10)
+// compressFiles starts cfg.workers goroutines compressing the given files.
+// For every file a result channel is sent on the returned queue in the order
+// of the items. The queue is closed after all files are dispatched.
+func compressFiles(ctx context.Context, cfg GeneratorConfig, items []fileItem) <-chan (<-chan compressResult) {
+	queue := make(chan (<-chan compressResult), cfg.workers)
+	jobs := make(chan compressJob)
+
+	for i := 0; i < cfg.workers; i++ {
+		go func() {
+			for j := range jobs {
+				if j.item.alias {
+					log.Printf("adding alias '%v'...\n", j.item.path)
+					j.res <- compressResult{item: j.item}
+					continue
+				}
+
+				log.Printf("processing file '%v'...\n", j.item.fullpath)
+				j.res <- compressFile(cfg, j.item)
+			}
+		}()
+	}
 
 	go func() {
-		err := filepath.Walk(cfg.src, func(p string, fi os.FileInfo, err error) error {
-			p = path.Clean(filepath.ToSlash(p))
-			// Do not process the source directory
-			if p == cfg.src {
-				return nil
+		defer close(jobs)
+		defer close(queue)
+
+		for _, f := range items {
+			res := make(chan compressResult, 1)
+			select {
+			case queue <- res:
+			case <-ctx.Done():
+				return
 			}
 
-			// Skip any directory if recursive is set to false (default)
-			if fi.IsDir() {
-				if !cfg.withSubdirs {
-					log.Printf("skipping directory '%v'...\n", p)
-					return filepath.SkipDir
-				}
-				return nil
+			select {
+			case jobs <- compressJob{item: f, res: res}:
+			case <-ctx.Done():
+				return
 			}
+		}
+	}()
 
-			vaultPath := strings.TrimPrefix(p, cfg.src)
-			// If include is set, then only process matching files
-			var skip bool
-			if len(cfg.incl) > 0 {
-				skip = !cfg.incl.matches(vaultPath) || cfg.excl.matches(vaultPath)
-			} else {
-				skip = cfg.excl.matches(vaultPath)
+	return queue
+}
+
+// compressFile returns the codec, the compressed content of the file and
+// the hex encoded SHA-256 hash of the uncompressed content. If the codec was not
+// set explicitly for the file, files not worth compressing are stored uncompressed.
+// Files larger than streamSize are not kept in memory, the codec is chosen by
+// compressing their first streamSize bytes and streamFile compresses them into the vault.
+func compressFile(cfg GeneratorConfig, item fileItem) compressResult {
+	res := compressResult{item: item, stream: item.fi.Size() > streamSize}
+	of, err := os.Open(item.fullpath)
+	if err != nil {
+		res.err = &WalkError{Path: item.fullpath, Err: err}
+		return res
+	}
+	defer of.Close()
+
+	// The first bytes are used to detect the content type
+	head := make([]byte, 512)
+	n, err := io.ReadFull(of, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		res.err = &WalkError{Path: item.fullpath, Err: err}
+		return res
+	}
+	head = head[:n]
+
+	codec, auto := cfg.codecFor(item.path)
+	if auto && codec != StoredCodec && cfg.skipCompressed && isCompressedFormat(item.path, head) {
+		log.Printf("storing already compressed file '%v'...\n", item.fullpath)
+		codec, auto = StoredCodec, false
+	}
+
+	if res.stream {
+		res.codec = codec
+		if auto && codec != StoredCodec {
+			var compSize countWriter
+			bw := newBlockWriter(&compSize, codec, cfg.cmpLvl, cfg.blockSize)
+			size, err := io.Copy(bw, io.MultiReader(bytes.NewReader(head), io.LimitReader(of, streamSize-int64(len(head)))))
+			if err != nil {
+				res.err = &WalkError{Path: item.fullpath, Err: err}
+				return res
 			}
 
-			if skip {
-				log.Printf("skipping file '%v'...\n", vaultPath)
-				return nil
+			if err = bw.Close(); err != nil {
+				res.err = err
+				return res
 			}
 
-			ch <- fileItem{path: vaultPath, fi: fi, fullpath: p}
-			return nil
-		})
-		if err != nil {
-			log.Fatalf("failed to walk source directory '%v': %v", cfg.src, err)
+			if !savesEnough(cfg, item, size, compSize.n) {
+				res.codec = StoredCodec
+			}
 		}
-		close(ch)
-	}()
+		return res
+	}
+
+	// A stored file is not compressed twice
+	h := sha256.New()
+	var raw, comp bytes.Buffer
+	var bw *blockWriter
+	var zw io.WriteCloser = nopWriteCloser{ioutil.Discard}
+	if codec != StoredCodec {
+		bw = newBlockWriter(&comp, codec, cfg.cmpLvl, cfg.blockSize)
+		zw = bw
+	}
 
-	return ch
+	size, err := io.Copy(io.MultiWriter(zw, h, &raw), io.MultiReader(bytes.NewReader(head), of))
+	if err != nil {
+		res.err = &WalkError{Path: item.fullpath, Err: err}
+		return res
+	}
+
+	if err = zw.Close(); err != nil {
+		res.err = err
+		return res
+	}
+
+	res.hash = hex.EncodeToString(h.Sum(nil))
+	if auto && codec != StoredCodec && !savesEnough(cfg, item, size, int64(comp.Len())) {
+		codec = StoredCodec
+	}
+
+	res.codec = codec
+	res.data = raw.Bytes()
+	if codec != StoredCodec {
+		res.data, res.blocks = comp.Bytes(), bw.blocks
+	}
+	return res
 }
 
-func (g *Generator) createStaticFile(fi string, fns ...func(w io.Writer)) {
-	log.Printf("creating file '%v'...", fi)
+// savesEnough reports whether compressing size bytes to compSize bytes saves at least
+// the minimal savings ratio.
+func savesEnough(cfg GeneratorConfig, item fileItem, size, compSize int64) bool {
+	if float64(size-compSize) < cfg.minSavings*float64(size) {
+		log.Printf("storing file '%v', compression saves less than %v%%...\n", item.fullpath, cfg.minSavings*100)
+		return false
+	}
+	return true
+}
+
+// streamFile compresses the file of the result with the codec chosen by compressFile,
+// writes it to w and records the hash and the blocks in the result. An error is returned
+// if the size of the file changed since it was walked.
+func streamFile(cfg GeneratorConfig, r *compressResult, w io.Writer) error {
+	log.Printf("streaming file '%v'...\n", r.item.fullpath)
+	of, err := os.Open(r.item.fullpath)
+	if err != nil {
+		return &WalkError{Path: r.item.fullpath, Err: err}
+	}
+	defer of.Close()
+
+	var bw *blockWriter
+	var zw io.WriteCloser = nopWriteCloser{w}
+	if r.codec != StoredCodec {
+		bw = newBlockWriter(w, r.codec, cfg.cmpLvl, cfg.blockSize)
+		zw = bw
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(zw, h), of)
+	if err != nil {
+		return &WalkError{Path: r.item.fullpath, Err: err}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if size != r.item.fi.Size() {
+		return &WalkError{Path: r.item.fullpath, Err: errors.New("file changed during generation")}
+	}
 
+	r.hash = hex.EncodeToString(h.Sum(nil))
+	if bw != nil {
+		r.blocks = bw.blocks
+	}
+	return nil
+}
+
+// dataWriter writes the data of a file with the shard writer
+// and records the position of the data in the vault.
+type dataWriter struct {
+	sw *shardWriter
+	// counter is only used to report the sizes of the encodings
+	counter        *sizeCounter
+	shard          int
+	offset, length int64
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	w.counter.write(p)
+	shard, offset, err := w.sw.write(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if w.length == 0 {
+		w.shard, w.offset = shard, offset
+	}
+	w.length += int64(len(p))
+	return len(p), nil
+}
+
+func getPath(p string) string {
+	idx := strings.LastIndex(p, "/")
+	if idx <= 0 {
+		return "/"
+	}
+
+	return path.Clean("/" + p[:idx])
+}
+
+func (g *Generator) createStaticFile(fi string, fns ...func(w io.Writer) error) error {
 	var buf bytes.Buffer
 	for i := range fns {
-		fns[i](&buf)
+		if err := fns[i](&buf); err != nil {
+			return &WriteError{File: fi, Err: err}
+		}
 	}
 
 	ff, err := format.Source(buf.Bytes())
 	if err != nil {
-		log.Fatalf("failed to format file: %v\n%s\n", err, buf.Bytes())
+		return &WriteError{File: fi, Err: fmt.Errorf("failed to format file: %w\n%s", err, buf.Bytes())}
+	}
+
+	// Keep the file untouched if the content did not change
+	if old, err := ioutil.ReadFile(fi); err == nil && bytes.Equal(old, ff) {
+		log.Printf("file '%v' is unchanged...", fi)
+		return nil
 	}
 
-	sf, err := os.OpenFile(fi, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	log.Printf("creating file '%v'...", fi)
+	if err := ioutil.WriteFile(fi, ff, 0600); err != nil {
+		return &WriteError{File: fi, Err: err}
+	}
+	return nil
+}
+
+// replaceFile renames src to dst, if dst has a different content.
+// Otherwise dst is kept untouched and src is removed.
+func replaceFile(src, dst string) error {
+	equal, err := equalFiles(src, dst)
 	if err != nil {
-		log.Fatalf("failed to create vault file for resource '%v': %v\n", g.config.name, err)
+		return &WriteError{File: dst, Err: err}
 	}
-	defer func() {
-		if err := sf.Close(); err != nil {
-			log.Fatalf("failed to close file: %v", err)
-		}
-	}()
 
-	if _, err := sf.Write(ff); err != nil {
-		log.Fatalf("failed to write to file: %v\n", err)
+	if equal {
+		log.Printf("file '%v' is unchanged...", dst)
+		return os.Remove(src)
 	}
+
+	log.Printf("creating file '%v'...", dst)
+	if err := os.Rename(src, dst); err != nil {
+		return &WriteError{File: dst, Err: err}
+	}
+	return nil
+}
+
+func equalFiles(a, b string) (bool, error) {
+	ha, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+
+	hb, err := hashFile(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return ha == hb, nil
+}
+
+// hashFile returns the hex encoded SHA-256 hash of the file content.
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // GeneratorConfig configures the vault generator.
 type GeneratorConfig struct {
-	src         string
-	dest        string
-	relPath     string
-	name        string
-	pkgName     string
-	excl        patterns
-	incl        patterns
-	withSubdirs bool
-	cmpLvl      int
+	mounts         []mount
+	dest           string
+	relPath        string
+	name           string
+	pkgName        string
+	excl           patterns
+	incl           patterns
+	syntax         PatternSyntax
+	exclM, inclM   matcher
+	withSubdirs    bool
+	emptyDirs      bool
+	ignoreFiles    bool
+	followLinks    bool
+	linkAliases    bool
+	compress       bool
+	codec          Codec
+	codecRules     []codecRule
+	cmpLvl         int
+	minSavings     float64
+	skipCompressed bool
+	encoding       Encoding
+	shardSize      int64
+	blockSize      int64
+	buildTag       string
+	debugFile      bool
+	maxFileSize    int64
+	workers        int
+	force          bool
+	modTime        time.Time
+	fixedModTime   bool
+	sourceEpoch    bool
 }
 
 // GeneratorOption configures the vault generator.
 type GeneratorOption func(g *GeneratorConfig)
 
 // NewGenerator creates a new generator instance with the given options.
-func NewGenerator(src, dest string, options ...GeneratorOption) Generator {
+// The source directory is mounted at the root of the vault, it may be empty
+// if other directories are mounted with the MountOption.
+// An error is returned if the package or resource name is invalid.
+func NewGenerator(src, dest string, options ...GeneratorOption) (Generator, error) {
+	var mounts []mount
+	if src != "" {
+		mounts = append(mounts, mount{prefix: "/", src: path.Clean(filepath.ToSlash(src)), primary: true})
+	}
+
 	cfg := GeneratorConfig{
-		src:    path.Clean(filepath.ToSlash(src)),
-		dest:   path.Clean(filepath.ToSlash(dest)),
-		cmpLvl: zlib.BestCompression}
+		mounts:         mounts,
+		dest:           path.Clean(filepath.ToSlash(dest)),
+		compress:       true,
+		codec:          ZlibCodec,
+		cmpLvl:         zlib.BestCompression,
+		minSavings:     0.05,
+		skipCompressed: true,
+		blockSize:      defaultBlockSize,
+		buildTag:       "debug",
+		debugFile:      true,
+		workers:        runtime.NumCPU()}
 	for i := range options {
 		options[i](&cfg)
 	}
-	initGeneratorConfig(&cfg)
+	if err := initGeneratorConfig(&cfg); err != nil {
+		return Generator{}, err
+	}
 	g := Generator{config: cfg}
 
-	g.sharedFile = fmt.Sprintf("%v/shared_%v_vault.go", cfg.dest, cfg.name)
+	g.sharedFile = fmt.Sprintf("%v/shared_vault.go", cfg.dest)
 	g.debugFile = fmt.Sprintf("%v/debug_%v_vault.go", cfg.dest, cfg.name)
 	g.releaseFile = fmt.Sprintf("%v/release_%v_vault.go", cfg.dest, cfg.name)
-	return g
+	g.asmFile = fmt.Sprintf("%v/release_%v_vault.s", cfg.dest, cfg.name)
+	g.manifestFile = fmt.Sprintf("%v/manifest_%v_vault.json", cfg.dest, cfg.name)
+	return g, nil
 }
 
-func initGeneratorConfig(cfg *GeneratorConfig) {
+func initGeneratorConfig(cfg *GeneratorConfig) error {
+	if len(cfg.mounts) == 0 {
+		return errors.New("no source directory to mount")
+	}
+
 	if cfg.pkgName == "" {
 		if cfg.pkgName = lastPath(cfg.dest); cfg.pkgName == "" {
-			log.Fatalln("could not determine package name: try to set package name manually")
+			return &InvalidPackageNameError{}
 		}
 	}
 
 	if cfg.name == "" {
-		if cfg.name = lastPath(cfg.src); cfg.name == "" {
+		if cfg.mounts[0].primary {
+			cfg.name = lastPath(cfg.mounts[0].src)
+		}
+
+		if cfg.name == "" {
 			cfg.name = cfg.pkgName
 		}
 	}
 
 	// check if identifiers are valid
 	if _, err := format.Source([]byte("package " + cfg.pkgName)); err != nil {
-		log.Fatalf("'%v' is an invalid package name: try to set a valid package name manually", cfg.pkgName)
+		return &InvalidPackageNameError{Name: cfg.pkgName}
 	}
 
 	if _, err := format.Source([]byte("var " + cfg.name + " string")); err != nil {
-		log.Fatalf("'%v' is an invalid resource name: try to set a valid resource name manually", cfg.name)
+		return &InvalidResourceNameError{Name: cfg.name}
+	}
+
+	if err := cfg.codec.valid(cfg.cmpLvl); err != nil {
+		return &InvalidOptionError{Option: "CodecOption", Err: err}
+	}
+
+	for _, r := range cfg.codecRules {
+		if err := r.codec.valid(cfg.cmpLvl); err != nil {
+			return &InvalidOptionError{Option: "FileCodecOption", Err: err}
+		}
+	}
+
+	var err error
+	if cfg.inclM, err = compilePatterns(cfg.syntax, cfg.incl); err != nil {
+		return err
 	}
+
+	if cfg.exclM, err = compilePatterns(cfg.syntax, cfg.excl); err != nil {
+		return err
+	}
+
+	// Copy the rules, so the compiled matchers are not shared with the options
+	cfg.codecRules = append([]codecRule(nil), cfg.codecRules...)
+	for i := range cfg.codecRules {
+		if cfg.codecRules[i].m, err = compilePatterns(cfg.syntax, cfg.codecRules[i].pats); err != nil {
+			return err
+		}
+	}
+
+	if cfg.sourceEpoch {
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			sec, err := strconv.ParseInt(epoch, 10, 64)
+			if err != nil {
+				return &InvalidOptionError{Option: "SourceDateEpochOption",
+					Err: fmt.Errorf("SOURCE_DATE_EPOCH '%v' is not a unix timestamp", epoch)}
+			}
+			cfg.modTime, cfg.fixedModTime = time.Unix(sec, 0), true
+		}
+	}
+
+	if int(cfg.encoding) >= len(encodingNames) {
+		return &InvalidOptionError{Option: "EncodingOption", Err: fmt.Errorf("unknown encoding %v", cfg.encoding)}
+	}
+
+	if _, err := constraint.Parse("//go:build " + cfg.buildTag); err != nil {
+		return &InvalidOptionError{Option: "BuildTagOption", Err: err}
+	}
+
+	if cfg.shardSize != 0 && cfg.shardSize < minShardSize {
+		return &InvalidOptionError{Option: "ShardSizeOption",
+			Err: fmt.Errorf("shard size %v is less than %v bytes", cfg.shardSize, minShardSize)}
+	}
+
+	if cfg.blockSize < 0 {
+		return &InvalidOptionError{Option: "BlockSizeOption", Err: fmt.Errorf("block size %v is negative", cfg.blockSize)}
+	}
+
+	if cfg.minSavings < 0 || cfg.minSavings > 1 {
+		return &InvalidOptionError{Option: "MinSavingsOption",
+			Err: fmt.Errorf("ratio %v is not between 0 and 1", cfg.minSavings)}
+	}
+	return nil
 }
 
 func lastPath(p string) string {
@@ -341,15 +834,178 @@ func lastPath(p string) string {
 	return p[idx+1:]
 }
 
-// CompressOption if set to true all files will be compressed,
-// otherwise no compression is used.
+// modTimeOf returns the modification time recorded in the vault for the file.
+func (cfg GeneratorConfig) modTimeOf(fi os.FileInfo) time.Time {
+	if cfg.fixedModTime {
+		return cfg.modTime
+	}
+	return fi.ModTime()
+}
+
+// ModTimeOption sets the modification time of all files in the vault to t instead
+// of the modification time in the source directory. Together with the lexical order
+// of the entries, identical content always results in identical generated files.
+func ModTimeOption(t time.Time) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.modTime = t
+		c.fixedModTime = true
+	}
+}
+
+// SourceDateEpochOption if set to true, the modification time of all files is set to the
+// unix timestamp of the SOURCE_DATE_EPOCH environment variable (see https://reproducible-builds.org).
+// If the variable is not set, the modification times of the source directory are used.
+// SOURCE_DATE_EPOCH takes precedence over the ModTimeOption.
+func SourceDateEpochOption(enable bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.sourceEpoch = enable
+	}
+}
+
+// EncodingOption sets the encoding of the data in the release file, default is EscapedEncoding.
+func EncodingOption(enc Encoding) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.encoding = enc
+	}
+}
+
+// ShardSizeOption splits the data of the vault into the shard files release_<name>_vault_000.go,
+// release_<name>_vault_001.go, ... instead of declaring it in the release file. No shard file
+// exceeds the given size in bytes, the data of a large file is split over several shards.
+// Shard files of previous runs are removed. The size must be at least 64 KiB, zero disables
+// sharding (default).
+func ShardSizeOption(size int64) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.shardSize = size
+	}
+}
+
+// BlockSizeOption sets the number of uncompressed bytes compressed as one independent block,
+// default is 64 KiB. The loader seeks to the block containing the offset and decompresses only
+// this block, so Seek and ReadAt of a large file cost at most the block size. Smaller blocks
+// compress less efficiently, zero compresses every file as one block.
+func BlockSizeOption(size int64) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.blockSize = size
+	}
+}
+
+// MaxFileSizeOption sets the maximum size of a single file in bytes, the generation fails with
+// a FileTooLargeError if a file is larger. Zero means no limit (default). Independent of this
+// option, large files are streamed through the compressor and never loaded into memory at once.
+func MaxFileSizeOption(size int64) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.maxFileSize = size
+	}
+}
+
+// BuildTagOption sets the build tag or build constraint expression (ex. "vaultdev" or
+// "dev && !prod") selecting the debug loader, default is "debug". The release files
+// are built if the expression is not satisfied.
+func BuildTagOption(tag string) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.buildTag = tag
+	}
+}
+
+// DebugFileOption if set to false, no debug file is generated and the release files
+// are built without any build constraint. Default is true.
+func DebugFileOption(generate bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.debugFile = generate
+	}
+}
+
+// buildConstraint returns the //go:build and // +build lines of the debug or release files.
+// Without debug file, the release files are not constrained.
+func (cfg GeneratorConfig) buildConstraint(debug bool) string {
+	if !cfg.debugFile {
+		return ""
+	}
+
+	// The tag is validated by NewGenerator
+	expr, _ := constraint.Parse("//go:build " + cfg.buildTag)
+	if !debug {
+		expr = &constraint.NotExpr{X: expr}
+	}
+
+	lines := []string{"//go:build " + expr.String()}
+	plus, err := constraint.PlusBuildLines(expr)
+	if err == nil {
+		lines = append(lines, plus...)
+	}
+	return strings.Join(lines, "\n") + "\n\n"
+}
+
+// CompressOption if set to true all files will be compressed (default),
+// otherwise all files are stored with the StoredCodec.
 func CompressOption(compress bool) GeneratorOption {
 	return func(c *GeneratorConfig) {
-		if compress {
-			c.cmpLvl = zlib.BestCompression
-		} else {
-			c.cmpLvl = zlib.NoCompression
+		c.compress = compress
+	}
+}
+
+// CodecOption sets the codec used to compress the files, default is ZlibCodec.
+func CodecOption(codec Codec) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.codec = codec
+	}
+}
+
+// FileCodecOption sets the codec used to compress files matching the patterns.
+// If a file matches multiple rules, the rule added first is used.
+// Patterns are interpreted according to the PatternSyntaxOption.
+func FileCodecOption(codec Codec, pattern ...string) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.codecRules = append(c.codecRules, codecRule{codec: codec, pats: pattern})
+	}
+}
+
+// MinSavingsOption sets the minimal ratio compression has to save, otherwise the file
+// is stored uncompressed. For example 0.1 stores all files which shrink less than 10%.
+// Default is 0.05, files with an explicit codec (see FileCodecOption) are not affected.
+func MinSavingsOption(ratio float64) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.minSavings = ratio
+	}
+}
+
+// SkipCompressedFormatsOption if set to true (default), files with a known compressed format
+// like jpeg, png, woff2 or zip are stored uncompressed without trying to compress them.
+// The format is determined by the file extension and the content of the file.
+// Files with an explicit codec (see FileCodecOption) are not affected.
+func SkipCompressedFormatsOption(skip bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.skipCompressed = skip
+	}
+}
+
+// CompressionLevelOption sets the compression level, the value must be between
+// flate.HuffmanOnly (-2) and flate.BestCompression (9), default is flate.BestCompression.
+// Codecs without compression levels ignore this option.
+func CompressionLevelOption(level int) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.cmpLvl = level
+	}
+}
+
+// WorkersOption sets the number of files compressed concurrently.
+// Values less than 1 are treated as 1, default is the number of CPUs.
+// The generated files are identical regardless of the number of workers.
+func WorkersOption(n int) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		if n < 1 {
+			n = 1
 		}
+		c.workers = n
+	}
+}
+
+// ForceOption if set to true, the vault is generated even if
+// the source files and the configuration did not change since the last run.
+func ForceOption(force bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.force = force
 	}
 }
 
@@ -363,7 +1019,7 @@ func PackageNameOption(name string) GeneratorOption {
 
 // ExcludeFilesOption sets the files to exclude in the generation process.
 // Only relative paths will be checked, so pattern must not include the fullpath.
-// Pattern matching follows the rules of regexp.Match (see https://golang.org/pkg/regexp/#Match).
+// Patterns are interpreted according to the PatternSyntaxOption.
 func ExcludeFilesOption(name ...string) GeneratorOption {
 	return func(c *GeneratorConfig) {
 		c.excl = append(c.excl, name...)
@@ -373,13 +1029,22 @@ func ExcludeFilesOption(name ...string) GeneratorOption {
 // IncludeFilesOption sets the files to include in the generation process.
 // Only specified files and files not matching any exclusion pattern will be included in the generation process.
 // Only relative paths will be checked, so pattern must not include the fullpath.
-// Pattern matching follows the rules of regexp.Match (see https://golang.org/pkg/regexp/#Match).
+// Patterns are interpreted according to the PatternSyntaxOption.
 func IncludeFilesOption(name ...string) GeneratorOption {
 	return func(c *GeneratorConfig) {
 		c.incl = append(c.incl, name...)
 	}
 }
 
+// PatternSyntaxOption sets the syntax of the include, exclude and codec patterns.
+// Default is RegexpSyntax (see https://golang.org/pkg/regexp/#Match),
+// see GlobSyntax for gitignore-style patterns.
+func PatternSyntaxOption(syntax PatternSyntax) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.syntax = syntax
+	}
+}
+
 // WithSubdirsOption if set to true, the generator will walk down
 // the folder tree with the source directory as root.
 func WithSubdirsOption(withSubdirs bool) GeneratorOption {
@@ -388,6 +1053,45 @@ func WithSubdirsOption(withSubdirs bool) GeneratorOption {
 	}
 }
 
+// EmptyDirsOption if set to true, the vault contains all directories walked, even if
+// they contain no files. Otherwise the vault only contains the directories of the files
+// (default). Only subdirectories walked with the WithSubdirsOption are included, ignored
+// directories are skipped like with the IgnoreFilesOption.
+func EmptyDirsOption(include bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.emptyDirs = include
+	}
+}
+
+// IgnoreFilesOption if set to true, the generator reads the .gitignore and .vaultignore
+// files in all directories of the source tree and skips the ignored files and directories.
+// Like git, the rules of an ignore file apply to the directory containing the file and
+// all its subdirectories. Ignore files are applied before the include and exclude patterns.
+func IgnoreFilesOption(ignore bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.ignoreFiles = ignore
+	}
+}
+
+// FollowSymlinksOption if set to true, the generator descends into symlinked
+// directories and embeds the content of symlinked files. Symlinks pointing to one
+// of their parent directories are skipped. Otherwise all symlinks are skipped (default).
+func FollowSymlinksOption(follow bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.followLinks = follow
+	}
+}
+
+// SymlinkAliasesOption if set to true, symlinks are followed like with the FollowSymlinksOption,
+// but files reached through a symlink are recorded as aliases of their target. Aliases
+// share the data of the target, so the content of a file is embedded only once. If the
+// target is not embedded, the first path in the vault keeps the data.
+func SymlinkAliasesOption(alias bool) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.linkAliases = alias
+	}
+}
+
 // ResourceNameOption sets the name of the generated resources.
 func ResourceNameOption(name string) GeneratorOption {
 	return func(c *GeneratorConfig) {
@@ -395,7 +1099,19 @@ func ResourceNameOption(name string) GeneratorOption {
 	}
 }
 
-// RelativePathOption sets the relative path for the debug asset loader.
+// MountOption mounts the source directory at the given prefix into the vault.
+// Files of all mounted directories are merged into one vault, the generator
+// returns a PathCollisionError if two files are mounted at the same path.
+func MountOption(vaultPrefix, srcDir string) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.mounts = append(c.mounts, mount{
+			prefix: path.Clean("/" + filepath.ToSlash(vaultPrefix)),
+			src:    path.Clean(filepath.ToSlash(srcDir)),
+		})
+	}
+}
+
+// RelativePathOption sets the relative path of the source directory for the debug asset loader.
 // If not specified the generator uses the relative path from the directory
 // where the generator was invoked.
 func RelativePathOption(p string) GeneratorOption {
@@ -412,43 +1128,51 @@ func RelativePathOption(p string) GeneratorOption {
 type fileModel struct {
 	Name, Path           string
 	Size, Offset, Length int64
+	Shard                int
 	ModTime              time.Time
+	Hash                 string
+	Codec                Codec
+	// Blocks contains the end offsets of the compressed blocks of BlockSize
+	// uncompressed bytes, nil if the file is compressed as one block
+	Blocks    []int64
+	BlockSize int64
 }
 
-type fileItem struct {
+// mount is a source directory mounted at prefix into the vault.
+type mount struct {
+	prefix, src string
+	// primary is set for the source directory passed to NewGenerator
+	primary bool
+}
+
+// dirItem is a directory walked, the vault records its modification time and mode.
+type dirItem struct {
 	path, fullpath string
 	fi             os.FileInfo
 }
 
-type binToStrWriter struct {
-	w      io.Writer
-	length int64
+type fileItem struct {
+	path, fullpath string
+	fi             os.FileInfo
+	// realpath is the absolute path without symlinks, only set for SymlinkAliasesOption
+	realpath string
+	// linked is set if the file is reached through a symlink, only set for SymlinkAliasesOption
+	linked bool
+	// alias is set if the item shares the data of the item with the index target
+	alias  bool
+	target int
 }
 
-func (bw *binToStrWriter) Write(p []byte) (n int, err error) {
-	var buf bytes.Buffer
-	for _, b := range p {
-		bw.length++
-
-		switch {
-		case b == '\n':
-			fprintf(&buf, `\n`)
-		case b == '\\':
-			fprintf(&buf, `\\`)
-		case b == '"':
-			fprintf(&buf, `\"`)
-		case b == '\t':
-			fallthrough
-		case (b >= 32 && b <= 126):
-			fprintf(&buf, "%c", b)
-		default:
-			fprintf(&buf, "\\x%02x", b)
-		}
-	}
+// fileWriter wraps all write errors into a WriteError.
+type fileWriter struct {
+	name string
+	w    io.Writer
+}
 
-	if _, err := bw.w.Write(buf.Bytes()); err != nil {
-		log.Fatalf("failed to write buffer to writer: %v", err)
+func (fw fileWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, &WriteError{File: fw.name, Err: err}
 	}
-
-	return buf.Len(), nil
+	return n, nil
 }
@@ -0,0 +1,25 @@
+//go:build go1.20
+// +build go1.20
+
+package vault
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/go-sharp/vault/testdata/gen"
+)
+
+func TestReadStoredFileNoCopy(t *testing.T) {
+	loader := gen.NewGenLoader()
+
+	// The content of a stored file references the data of the vault
+	s1, err := loader.ReadString("/gopher.jpeg")
+	if err != nil {
+		t.Fatalf("ReadString: %v\n", err)
+	}
+	s2, _ := loader.ReadString("/gopher.jpeg")
+	if unsafe.StringData(s1) != unsafe.StringData(s2) {
+		t.Errorf("ReadString: content of stored file was copied\n")
+	}
+}
@@ -9,11 +9,33 @@ package vault
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/go-sharp/vault/testdata/gen"
 )
@@ -135,6 +157,52 @@ func TestDirectoryContent(t *testing.T) {
 	}
 }
 
+func TestBuildDirIndex(t *testing.T) {
+	// The files are sorted by path, "/a-b/y" and "/a.txt" sort before "/a/b/c/z"
+	files := []fileModel{
+		{Path: "/a-b", Name: "y", Size: 2},
+		{Path: "/", Name: "a.txt", Size: 1},
+		{Path: "/a/b/c", Name: "z", Size: 4},
+		{Path: "/a", Name: "x", Size: 8},
+	}
+
+	want := []dirModel{
+		{Path: "/", Mode: defaultDirMode, Size: 15, Dirs: []int{1, 2}, Files: []int{1}},
+		{Path: "/a", Mode: defaultDirMode, Size: 12, Dirs: []int{3}, Files: []int{3}},
+		{Path: "/a-b", Mode: defaultDirMode, Size: 2, Files: []int{0}},
+		{Path: "/a/b", Mode: defaultDirMode, Size: 4, Dirs: []int{4}},
+		{Path: "/a/b/c", Mode: defaultDirMode, Size: 4, Files: []int{2}},
+	}
+	if got := buildDirIndex(GeneratorConfig{}, files, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildDirIndex: got %+v want %+v\n", got, want)
+	}
+
+	if got := buildDirIndex(GeneratorConfig{}, nil, nil); !reflect.DeepEqual(got, []dirModel{{Path: "/", Mode: defaultDirMode}}) {
+		t.Errorf("buildDirIndex: empty vault got %+v want only the root directory\n", got)
+	}
+}
+
+func TestDirMetadata(t *testing.T) {
+	fs := gen.NewGenLoader()
+	for _, name := range []string{"/", "/data", "/data/json"} {
+		fi, err := os.Stat(filepath.Join("./testdata/assets", name))
+		if err != nil {
+			t.Fatalf("Stat: %v\n", err)
+		}
+
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open: missing directory %v error: %v\n", name, err)
+		}
+		got, _ := f.Stat()
+		f.Close()
+
+		if got.ModTime().Unix() != fi.ModTime().Unix() || got.Mode() != os.ModeDir|fi.Mode().Perm() {
+			t.Errorf("Stat: %v get %v %v, want = %v %v\n", name, got.ModTime(), got.Mode(), fi.ModTime(), os.ModeDir|fi.Mode().Perm())
+		}
+	}
+}
+
 func TestSeekInvalidOffset(t *testing.T) {
 	fname := "/text.txt"
 	fs := gen.NewGenLoader()
@@ -155,6 +223,48 @@ func TestSeekInvalidOffset(t *testing.T) {
 	}
 }
 
+func TestSeekBeyondEnd(t *testing.T) {
+	want, err := ioutil.ReadFile("./testdata/assets/text.txt")
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	size := int64(len(want))
+
+	f, err := gen.NewGenLoader().Open("/text.txt")
+	if err != nil {
+		t.Fatalf("Open: %v\n", err)
+	}
+	defer f.Close()
+
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{offset: size + 10, whence: io.SeekStart, want: size + 10},
+		{offset: -5, whence: io.SeekCurrent, want: size + 5},
+		{offset: 0, whence: io.SeekCurrent, want: size + 5},
+	} {
+		if got, err := f.Seek(tc.offset, tc.whence); err != nil || got != tc.want {
+			t.Fatalf("Seek(%v, %v): get %v, want = %v -> error: %v\n", tc.offset, tc.whence, got, tc.want, err)
+		}
+
+		if n, err := f.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Fatalf("Read: get %v %v, want = 0 io.EOF\n", n, err)
+		}
+	}
+
+	if got, err := f.Seek(-15, io.SeekCurrent); err != nil || got != size-10 {
+		t.Fatalf("Seek: get %v, want = %v -> error: %v\n", got, size-10, err)
+	}
+
+	buf := make([]byte, 20)
+	n, err := io.ReadFull(f, buf)
+	if err != io.ErrUnexpectedEOF || !bytes.Equal(buf[:n], want[size-10:]) {
+		t.Errorf("Read: get %q, want = %q -> error: %v\n", buf[:n], want[size-10:], err)
+	}
+}
+
 func TestSeekFile(t *testing.T) {
 	fname := "/text.txt"
 	fs := gen.NewGenLoader()
@@ -208,6 +318,290 @@ func TestSeekFile(t *testing.T) {
 	}
 }
 
+func TestFileHash(t *testing.T) {
+	fs := gen.NewGenLoader()
+	for _, name := range []string{"/text.txt", "/gopher.jpeg", "/data/json/readme.md"} {
+		data, err := ioutil.ReadFile(filepath.Join("./testdata/assets", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("ReadFile: %v\n", err)
+		}
+		want := fmt.Sprintf("%x", sha256.Sum256(data))
+
+		if hash, err := fs.Hash(name); err != nil || hash != want {
+			t.Errorf("Hash: get %v, want = %v -> error: %v\n", hash, want, err)
+		}
+
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open: missing file %v error: %v\n", name, err)
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatalf("Stat: %v\n", err)
+		}
+
+		if fi.Sys() != want {
+			t.Errorf("Stat: Sys get %v, want = %v\n", fi.Sys(), want)
+		}
+
+		// Reading the whole file verifies the content
+		if _, err := ioutil.ReadAll(f); err != nil {
+			t.Errorf("ReadAll: %v\n", err)
+		}
+	}
+
+	if _, err := fs.Hash("/data"); err == nil {
+		t.Errorf("Hash: get nil, want = error for directory\n")
+	}
+}
+
+func TestFS(t *testing.T) {
+	fsys := gen.NewGenLoader().FS()
+	if err := fstest.TestFS(fsys, "text.txt", "gopher.jpeg", "bin/umlet.jar", "data/json/appsettings.json"); err != nil {
+		t.Fatalf("TestFS: %v\n", err)
+	}
+
+	data, err := fs.ReadFile(fsys, "data/json/readme.md")
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+
+	want, _ := ioutil.ReadFile("./testdata/assets/data/json/readme.md")
+	if !bytes.Equal(data, want) {
+		t.Errorf("ReadFile: content differs from source file\n")
+	}
+
+	matches, err := fs.Glob(fsys, "data/*/*.json")
+	if err != nil || len(matches) != 1 || matches[0] != "data/json/appsettings.json" {
+		t.Errorf("Glob: got %v, %v want [data/json/appsettings.json]\n", matches, err)
+	}
+
+	sub, err := fs.Sub(fsys, "data")
+	if err != nil {
+		t.Fatalf("Sub: %v\n", err)
+	}
+
+	if _, err := fs.Stat(sub, "json/readme.md"); err != nil {
+		t.Errorf("Sub: Stat: %v\n", err)
+	}
+
+	if _, err := fs.Stat(fsys, "missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: want fs.ErrNotExist, got %v\n", err)
+	}
+}
+
+func TestBlockReadAt(t *testing.T) {
+	want, err := ioutil.ReadFile("./testdata/assets/data/css.css")
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+
+	f, err := gen.NewGenLoader().Open("/data/css.css")
+	if err != nil {
+		t.Fatalf("Open: %v\n", err)
+	}
+	defer f.Close()
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		t.Fatalf("ReadAt: %T does not implement io.ReaderAt\n", f)
+	}
+
+	// The offsets are in both blocks of the file and across the block boundary
+	var wg sync.WaitGroup
+	for _, off := range []int{0, 100, 65530, 65536, 80000, len(want) - 10} {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			buf := make([]byte, 20)
+			n, err := ra.ReadAt(buf, int64(off))
+			end := off + len(buf)
+			if end > len(want) {
+				end = len(want)
+			}
+
+			if (err != nil && err != io.EOF) || !bytes.Equal(buf[:n], want[off:end]) {
+				t.Errorf("ReadAt(%v): got %q, %v want = %q\n", off, buf[:n], err, want[off:end])
+			}
+		}(off)
+	}
+	wg.Wait()
+
+	// Seek backwards into the first block and read up to the end
+	if _, err := f.Seek(int64(len(want)-5), io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v\n", err)
+	}
+
+	if _, err := f.Seek(1000, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v\n", err)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(data, want[1000:]) {
+		t.Errorf("Seek: content after seek differs from source file: %v\n", err)
+	}
+
+	if _, err := NewGenerator("./testdata/assets", "./testdata/gen", BlockSizeOption(-1)); !errors.As(err, new(*InvalidOptionError)) {
+		t.Errorf("BlockSizeOption: want InvalidOptionError, got %v\n", err)
+	}
+}
+
+func TestReadStoredFile(t *testing.T) {
+	loader := gen.NewGenLoader()
+	want, _ := ioutil.ReadFile("./testdata/assets/gopher.jpeg")
+
+	s1, err := loader.ReadString("/gopher.jpeg")
+	if err != nil || s1 != string(want) {
+		t.Fatalf("ReadString: content differs from source file: %v\n", err)
+	}
+
+	css, _ := ioutil.ReadFile("./testdata/assets/data/css.css")
+	if s, err := loader.ReadString("/data/css.css"); err != nil || s != string(css) {
+		t.Errorf("ReadString: content of compressed file differs from source file: %v\n", err)
+	}
+
+	f, err := loader.Open("/gopher.jpeg")
+	if err != nil {
+		t.Fatalf("Open: %v\n", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 100)
+	if n, err := f.(io.ReaderAt).ReadAt(buf, int64(len(want)-50)); n != 50 || err != io.EOF || !bytes.Equal(buf[:n], want[len(want)-50:]) {
+		t.Errorf("ReadAt: got %v, %v want = 50, EOF\n", n, err)
+	}
+}
+
+func TestCacheOption(t *testing.T) {
+	css, _ := ioutil.ReadFile("./testdata/assets/data/css.css")
+	open := func(loader gen.AssetLoader, name string) {
+		data, err := loader.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile: %v\n", err)
+		}
+
+		if name == "/data/css.css" && !bytes.Equal(data, css) {
+			t.Errorf("ReadFile: content differs from source file\n")
+		}
+	}
+
+	loader := gen.NewGenLoader()
+	open(loader, "/data/css.css")
+	if stats := loader.CacheStats(); stats != (gen.CacheStats{}) {
+		t.Errorf("NoCache: got %+v want no counters\n", stats)
+	}
+
+	// The cache holds css.css or structure.sql, but not both
+	loader = gen.NewGenLoader(gen.CacheOption(gen.LRUCache(int64(len(css) + 100))))
+	for _, name := range []string{"/data/css.css", "/data/css.css", "/bin/structure.sql", "/data/css.css", "/gopher.jpeg"} {
+		open(loader, name)
+	}
+
+	if stats := loader.CacheStats(); stats.Hits != 1 || stats.Misses != 3 || stats.Size != int64(len(css)) {
+		t.Errorf("LRUCache: got %+v want 1 hit, 3 misses and size %v\n", stats, len(css))
+	}
+
+	// A file larger than the cache bypasses it, opening a file does not look it up
+	loader = gen.NewGenLoader(gen.CacheOption(gen.LRUCache(int64(len(css) - 1))))
+	for i := 0; i < 2; i++ {
+		if s, err := loader.ReadString("/data/css.css"); err != nil || s != string(css) {
+			t.Errorf("ReadString: content differs from source file: %v\n", err)
+		}
+	}
+
+	f, err := loader.Open("/data/css.css")
+	if err != nil {
+		t.Fatalf("Open: %v\n", err)
+	}
+	defer f.Close()
+
+	p := make([]byte, 100)
+	if n, err := f.(io.ReaderAt).ReadAt(p, 1000); err != nil || !bytes.Equal(p[:n], css[1000:1100]) {
+		t.Errorf("ReadAt: content differs from source file: %v\n", err)
+	}
+
+	if _, err := loader.Hash("/text.txt"); err != nil || !loader.Exists("/text.txt") {
+		t.Errorf("Hash: %v\n", err)
+	}
+
+	if stats := loader.CacheStats(); stats != (gen.CacheStats{}) {
+		t.Errorf("LRUCache: got %+v want no counters\n", stats)
+	}
+
+	loader = gen.NewGenLoader(gen.CacheOption(gen.EagerCache))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			open(loader, "/data/css.css")
+		}()
+	}
+	wg.Wait()
+
+	if stats := loader.CacheStats(); stats.Hits != 4 || stats.Misses != 0 || stats.Size <= int64(len(css)) {
+		t.Errorf("EagerCache: got %+v want 4 hits and all compressed files\n", stats)
+	}
+}
+
+func TestLoaderHelpers(t *testing.T) {
+	loader := gen.NewGenLoader()
+	want, _ := ioutil.ReadFile("./testdata/assets/data/css.css")
+	if data, err := loader.ReadFile("/data/css.css"); err != nil || !bytes.Equal(data, want) {
+		t.Errorf("ReadFile: content differs from source file: %v\n", err)
+	}
+
+	if data := loader.MustReadFile("data/css.css"); !bytes.Equal(data, want) {
+		t.Errorf("MustReadFile: content differs from source file\n")
+	}
+
+	if _, err := loader.ReadFile("/data"); err == nil {
+		t.Errorf("ReadFile: want error for directory\n")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("MustReadFile: want panic for missing file\n")
+			}
+		}()
+		loader.MustReadFile("/missing.txt")
+	}()
+
+	for name, want := range map[string]bool{"/text.txt": true, "/data/json": true, "/missing.txt": false, "/dat": false} {
+		if got := loader.Exists(name); got != want {
+			t.Errorf("Exists(%v): got %v want = %v\n", name, got, want)
+		}
+	}
+
+	names := loader.Names()
+	if len(names) != 9 || names[0] != "/.somespecialfile" || names[8] != "/text.txt" {
+		t.Errorf("Names: got %v\n", names)
+	}
+
+	var walked []string
+	err := loader.Walk("/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && name == "/bin" {
+			return fs.SkipDir
+		}
+
+		walked = append(walked, name)
+		return nil
+	})
+
+	wantWalk := []string{"/", "/.somespecialfile", "/data", "/data/css.css", "/data/golang-header.jpg", "/data/json",
+		"/data/json/appsettings.json", "/data/json/readme.md", "/gopher.jpeg", "/text.txt"}
+	if err != nil || strings.Join(walked, ",") != strings.Join(wantWalk, ",") {
+		t.Errorf("Walk: got %v, %v want = %v\n", walked, err, wantWalk)
+	}
+}
+
 func TestFileGeneration(t *testing.T) {
 	type file struct {
 		name string
@@ -349,3 +743,1346 @@ func TestFileGeneration(t *testing.T) {
 		})
 	}
 }
+
+func TestNewGeneratorInvalidNames(t *testing.T) {
+	_, err := NewGenerator("./testdata/assets", "./testdata/gen", PackageNameOption("1gen"))
+	var pkgErr *InvalidPackageNameError
+	if !errors.As(err, &pkgErr) || pkgErr.Name != "1gen" {
+		t.Fatalf("NewGenerator: get %v, want = InvalidPackageNameError\n", err)
+	}
+
+	_, err = NewGenerator("./testdata/assets", "./testdata/gen", ResourceNameOption("my-res"))
+	var resErr *InvalidResourceNameError
+	if !errors.As(err, &resErr) || resErr.Name != "my-res" {
+		t.Fatalf("NewGenerator: get %v, want = InvalidResourceNameError\n", err)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	dest, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(dest)
+
+	g, err := NewGenerator("./testdata/assets", dest, PackageNameOption("gen"), WithSubdirsOption(true))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := g.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run: get %v, want = %v\n", err, context.Canceled)
+	}
+}
+
+func TestRunWalkError(t *testing.T) {
+	dest, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(dest)
+
+	g, err := NewGenerator("./testdata/missing", dest, PackageNameOption("gen"))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	var walkErr *WalkError
+	if err := g.Run(context.Background()); !errors.As(err, &walkErr) {
+		t.Fatalf("Run: get %v, want = WalkError\n", err)
+	}
+}
+
+func TestWorkersDeterministic(t *testing.T) {
+	var releases [][]byte
+	for _, workers := range []int{1, 8} {
+		dest, err := ioutil.TempDir("", "vault")
+		if err != nil {
+			t.Fatalf("TempDir: %v\n", err)
+		}
+		defer os.RemoveAll(dest)
+
+		g, err := NewGenerator("./testdata/assets", dest, PackageNameOption("gen"),
+			ResourceNameOption("gen"), WithSubdirsOption(true), WorkersOption(workers))
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		if err := g.Run(context.Background()); err != nil {
+			t.Fatalf("Run: workers = %v error: %v\n", workers, err)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dest, "release_gen_vault.go"))
+		if err != nil {
+			t.Fatalf("ReadFile: %v\n", err)
+		}
+		releases = append(releases, data)
+	}
+
+	if !bytes.Equal(releases[0], releases[1]) {
+		t.Fatalf("Run: release files differ depending on the number of workers\n")
+	}
+}
+
+func TestRunUpToDate(t *testing.T) {
+	dest, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(dest)
+
+	run := func(options ...GeneratorOption) Report {
+		options = append(options, PackageNameOption("gen"), ResourceNameOption("gen"), WithSubdirsOption(true))
+		g, err := NewGenerator("./testdata/assets", dest, options...)
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		if err := g.Run(context.Background()); err != nil {
+			t.Fatalf("Run: %v\n", err)
+		}
+		return g.Report()
+	}
+
+	if r := run(); r.UpToDate || r.Files != 9 {
+		t.Fatalf("Run: first run get %+v, want = {UpToDate:false Files:9}\n", r)
+	}
+
+	release := filepath.Join(dest, "release_gen_vault.go")
+	old := time.Unix(1551297978, 0)
+	if err := os.Chtimes(release, old, old); err != nil {
+		t.Fatalf("Chtimes: %v\n", err)
+	}
+
+	if r := run(); !r.UpToDate {
+		t.Fatalf("Run: second run get %+v, want = {UpToDate:true Files:9}\n", r)
+	}
+
+	if r := run(ForceOption(true)); r.UpToDate {
+		t.Fatalf("Run: forced run get %+v, want = {UpToDate:false Files:9}\n", r)
+	}
+
+	// The release file must not be touched if its content did not change
+	if fi, err := os.Stat(release); err != nil || !fi.ModTime().Equal(old) {
+		t.Fatalf("Run: release file was rewritten with identical content: %v\n", err)
+	}
+
+	if r := run(CompressOption(false)); r.UpToDate {
+		t.Fatalf("Run: changed options get %+v, want = {UpToDate:false Files:9}\n", r)
+	}
+}
+
+func TestRunUpToDateTouched(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src, dest := filepath.Join(tmp, "assets"), filepath.Join(tmp, "res")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v\n", err)
+	}
+
+	text := filepath.Join(src, "text.txt")
+	if err := ioutil.WriteFile(text, []byte("touched, but not changed"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+
+	run := func(mtime int64, options ...GeneratorOption) Report {
+		if err := os.Chtimes(text, time.Unix(mtime, 0), time.Unix(mtime, 0)); err != nil {
+			t.Fatalf("Chtimes: %v\n", err)
+		}
+
+		g, err := NewGenerator(src, dest, options...)
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		if err := g.Run(context.Background()); err != nil {
+			t.Fatalf("Run: %v\n", err)
+		}
+		return g.Report()
+	}
+
+	// With a fixed modification time a touched file is compared by its content
+	fixed := ModTimeOption(time.Unix(1500000000, 0))
+	run(1000, fixed)
+	manifest := filepath.Join(dest, "manifest_assets_vault.json")
+	old := time.Unix(1551297978, 0)
+	if err := os.Chtimes(manifest, old, old); err != nil {
+		t.Fatalf("Chtimes: %v\n", err)
+	}
+
+	if r := run(2000, fixed); !r.UpToDate {
+		t.Errorf("Run: touched file with fixed modification time get %+v, want = {UpToDate:true}\n", r)
+	}
+
+	// The manifest does not depend on the modification times of the source files
+	run(3000, fixed, ForceOption(true))
+	if fi, err := os.Stat(manifest); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("Run: manifest was rewritten with identical content: %v\n", err)
+	}
+
+	// Otherwise the vault contains the modification time of the source file
+	run(1000)
+	if r := run(2000); r.UpToDate {
+		t.Errorf("Run: touched file get %+v, want = {UpToDate:false}\n", r)
+	}
+}
+
+func TestMountOption(t *testing.T) {
+	dest, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(dest)
+
+	testCases := []struct {
+		desc      string
+		src       string
+		mounts    [][2]string
+		files     int
+		collision string
+		// zeroDir is a directory without source directory
+		zeroDir string
+	}{
+		{desc: "Mount only", mounts: [][2]string{{"/web", "./testdata/assets/data"}}, files: 4, zeroDir: "/"},
+		{desc: "Source and mount", src: "./testdata/assets",
+			mounts: [][2]string{{"/more", "./testdata/assets/bin"}}, files: 11},
+		{desc: "File collision", src: "./testdata/assets",
+			mounts: [][2]string{{"/bin", "./testdata/assets/bin"}}, collision: "/bin/structure.sql"},
+		{desc: "Directory collision", src: "./testdata/assets",
+			mounts: [][2]string{{"/text.txt", "./testdata/assets/bin"}}, collision: "/text.txt"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			options := []GeneratorOption{PackageNameOption("gen"), ResourceNameOption("gen"), WithSubdirsOption(true)}
+			for _, m := range tc.mounts {
+				options = append(options, MountOption(m[0], m[1]))
+			}
+
+			g, err := NewGenerator(tc.src, dest, options...)
+			if err != nil {
+				t.Fatalf("NewGenerator: %v\n", err)
+			}
+
+			err = g.Run(context.Background())
+			if tc.collision != "" {
+				var colErr *PathCollisionError
+				if !errors.As(err, &colErr) || colErr.Path != tc.collision {
+					t.Fatalf("Run: get %v, want = collision at %v\n", err, tc.collision)
+				}
+				return
+			}
+
+			if err != nil || g.Report().Files != tc.files {
+				t.Fatalf("Run: files get %v, want = %v -> error: %v\n", g.Report().Files, tc.files, err)
+			}
+
+			// The loader returns the zero time for a modification time of 0
+			data, err := ioutil.ReadFile(filepath.Join(dest, "release_gen_vault.go"))
+			if err != nil {
+				t.Fatalf("ReadFile: %v\n", err)
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if tc.zeroDir != "" && strings.Contains(line, fmt.Sprintf("{path: %q,", tc.zeroDir)) && !strings.Contains(line, "modTime: 0,") {
+					t.Errorf("Run: directory %v has a modification time: %v\n", tc.zeroDir, line)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyDirsOption(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src, dest := filepath.Join(tmp, "src"), filepath.Join(tmp, "res")
+	mtime := time.Unix(1500000000, 0)
+	for _, dir := range []string{"a/empty", "empty"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0750); err != nil {
+			t.Fatalf("MkdirAll: %v\n", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a", "x.txt"), []byte("x"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "empty"), mtime, mtime); err != nil {
+		t.Fatalf("Chtimes: %v\n", err)
+	}
+
+	dirs := func(options ...GeneratorOption) []dirModel {
+		g, err := NewGenerator(src, dest, append(options, WithSubdirsOption(true))...)
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		items, walked, err := walkSrcDirectory(context.Background(), g.config)
+		if err != nil {
+			t.Fatalf("walkSrcDirectory: %v\n", err)
+		}
+
+		var files []fileModel
+		for _, item := range items {
+			files = append(files, fileModel{Path: getPath(item.path), Name: item.fi.Name(), Size: item.fi.Size()})
+		}
+		return buildDirIndex(g.config, files, walked)
+	}
+
+	var paths []string
+	for _, d := range dirs() {
+		paths = append(paths, d.Path)
+	}
+	if want := []string{"/", "/a"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("buildDirIndex: get %v, want = %v\n", paths, want)
+	}
+
+	got := dirs(EmptyDirsOption(true))
+	paths = nil
+	for _, d := range got {
+		paths = append(paths, d.Path)
+	}
+	if want := []string{"/", "/a", "/a/empty", "/empty"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("EmptyDirsOption: get %v, want = %v\n", paths, want)
+	}
+	if d := got[3]; d.ModTime.Unix() != mtime.Unix() || d.Mode != 0750 || d.Size != 0 {
+		t.Errorf("EmptyDirsOption: /empty get %v %v %v, want = %v %v 0\n", d.ModTime, d.Mode, d.Size, mtime, os.FileMode(0750))
+	}
+
+	if d := dirs(EmptyDirsOption(true), ModTimeOption(time.Unix(42, 0)))[3]; d.ModTime.Unix() != 42 {
+		t.Errorf("ModTimeOption: /empty get %v, want = 42\n", d.ModTime.Unix())
+	}
+
+	// An empty directory collides with a file mounted at its path
+	other := filepath.Join(tmp, "other")
+	if err := os.MkdirAll(other, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v\n", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(other, "empty"), []byte("file"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	for _, include := range []bool{false, true} {
+		g, err := NewGenerator(src, dest, WithSubdirsOption(true), EmptyDirsOption(include), MountOption("/", other))
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		_, _, err = walkSrcDirectory(context.Background(), g.config)
+		var colErr *PathCollisionError
+		if got := errors.As(err, &colErr) && colErr.Path == "/empty"; got != include {
+			t.Errorf("walkSrcDirectory: empty directories %v, get %v, want collision = %v\n", include, err, include)
+		}
+	}
+
+	// A changed directory is detected by the manifest
+	g, err := NewGenerator(src, dest, WithSubdirsOption(true), EmptyDirsOption(true))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+	for i, want := range []bool{false, true, false} {
+		if i == 2 {
+			if err := os.Chtimes(filepath.Join(src, "empty"), mtime.Add(time.Hour), mtime.Add(time.Hour)); err != nil {
+				t.Fatalf("Chtimes: %v\n", err)
+			}
+		}
+
+		if err := g.Run(context.Background()); err != nil {
+			t.Fatalf("Run: %v\n", err)
+		}
+		if g.Report().UpToDate != want {
+			t.Errorf("Run %v: up to date get %v, want = %v\n", i, g.Report().UpToDate, want)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "release_src_vault.go"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	want := fmt.Sprintf(`{path: "/empty", size: 0, modTime: %v, mode: 0750},`, mtime.Add(time.Hour).Unix())
+	if !strings.Contains(string(data), want) {
+		t.Errorf("release file does not contain %v\n", want)
+	}
+}
+
+func TestCodecOptions(t *testing.T) {
+	for _, name := range []string{"stored", "zlib", "deflate", "gzip", "lzw"} {
+		c, err := ParseCodec(name)
+		if err != nil || c.String() != name {
+			t.Fatalf("ParseCodec: get %v, want = %v -> error: %v\n", c, name, err)
+		}
+	}
+
+	if _, err := ParseCodec("brotli"); err == nil {
+		t.Fatalf("ParseCodec: unknown codec must return an error\n")
+	}
+
+	_, err := NewGenerator("./testdata/assets", "./testdata/gen",
+		CodecOption(GzipCodec), CompressionLevelOption(12))
+	var optErr *InvalidOptionError
+	if !errors.As(err, &optErr) {
+		t.Fatalf("NewGenerator: get %v, want = InvalidOptionError\n", err)
+	}
+
+	if _, err := NewGenerator("./testdata/assets", "./testdata/gen",
+		CodecOption(LZWCodec), CompressionLevelOption(12)); err != nil {
+		t.Fatalf("NewGenerator: lzw must ignore the level: %v\n", err)
+	}
+}
+
+func TestStoreCompressedFormats(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		options []GeneratorOption
+		stored  []string
+	}{
+		{desc: "Default", stored: []string{"/bin/umlet.jar", "/data/golang-header.jpg", "/gopher.jpeg"}},
+		{desc: "Compress all", options: []GeneratorOption{SkipCompressedFormatsOption(false), MinSavingsOption(0)}},
+		{desc: "Explicit codec", options: []GeneratorOption{FileCodecOption(ZlibCodec, "[.]jpe?g$")},
+			stored: []string{"/bin/umlet.jar"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			g, err := NewGenerator("./testdata/assets", "./testdata/gen",
+				append(tc.options, WithSubdirsOption(true))...)
+			if err != nil {
+				t.Fatalf("NewGenerator: %v\n", err)
+			}
+
+			cfg := g.config
+			items, _, err := walkSrcDirectory(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("walkSrcDirectory: %v\n", err)
+			}
+
+			var stored []string
+			for _, item := range items {
+				r := compressFile(cfg, item)
+				if r.err != nil {
+					t.Fatalf("compressFile: %v\n", r.err)
+				}
+
+				if r.codec == StoredCodec {
+					stored = append(stored, item.path)
+				}
+			}
+
+			if fmt.Sprint(stored) != fmt.Sprint(tc.stored) {
+				t.Fatalf("compressFile: stored get %v, want = %v\n", stored, tc.stored)
+			}
+		})
+	}
+}
+
+func TestGlobPatterns(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		pats  []string
+		path  string
+		match bool
+	}{
+		{desc: "Basename at any level", pats: []string{"*.json"}, path: "/data/json/appsettings.json", match: true},
+		{desc: "Star does not match slash", pats: []string{"data/*.json"}, path: "/data/json/appsettings.json"},
+		{desc: "Double star", pats: []string{"data/**/*.json"}, path: "/data/json/appsettings.json", match: true},
+		{desc: "Leading double star", pats: []string{"**/json/readme.md"}, path: "/data/json/readme.md", match: true},
+		{desc: "Trailing double star", pats: []string{"data/**"}, path: "/data/json/readme.md", match: true},
+		{desc: "Anchored", pats: []string{"/json"}, path: "/data/json/readme.md"},
+		{desc: "Directory only", pats: []string{"json/"}, path: "/data/json/readme.md", match: true},
+		{desc: "Directory only file", pats: []string{"text.txt/"}, path: "/text.txt"},
+		{desc: "Negation", pats: []string{"*.md", "!readme.md"}, path: "/data/json/readme.md"},
+		{desc: "Negation order", pats: []string{"!readme.md", "*.md"}, path: "/data/json/readme.md", match: true},
+		{desc: "Character class", pats: []string{"gopher.jp[!e]g"}, path: "/gopher.jpeg"},
+		{desc: "Question mark", pats: []string{"text.tx?"}, path: "/text.txt", match: true},
+		{desc: "Comment", pats: []string{"#text.txt"}, path: "/text.txt"},
+		{desc: "Escape", pats: []string{`\#text.txt`}, path: "/#text.txt", match: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, err := compilePatterns(GlobSyntax, tc.pats)
+			if err != nil {
+				t.Fatalf("compilePatterns: %v\n", err)
+			}
+
+			if m.matches(tc.path) != tc.match {
+				t.Fatalf("matches: %v with %v get %v, want = %v\n", tc.path, tc.pats, !tc.match, tc.match)
+			}
+		})
+	}
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		option GeneratorOption
+	}{
+		{desc: "Regexp", option: ExcludeFilesOption("[.json")},
+		{desc: "Glob", option: IncludeFilesOption("data/[a-z")},
+		{desc: "Codec", option: FileCodecOption(GzipCodec, `data\`)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			syntax := GlobSyntax
+			if tc.desc == "Regexp" {
+				syntax = RegexpSyntax
+			}
+
+			_, err := NewGenerator("./testdata/assets", "./testdata/gen", PatternSyntaxOption(syntax), tc.option)
+			var patErr *InvalidPatternError
+			if !errors.As(err, &patErr) {
+				t.Fatalf("NewGenerator: get %v, want = InvalidPatternError\n", err)
+			}
+		})
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(src)
+
+	files := map[string]string{
+		".gitignore":             "*.log\nbuild/\n/root.txt\n",
+		".vaultignore":           "*.swp\n",
+		"root.txt":               "ignored by anchored rule",
+		"app.log":                "ignored",
+		"index.html":             "kept",
+		"build/out.js":           "ignored directory",
+		"web/.gitignore":         "!keep.log\n*.tmp\n",
+		"web/keep.log":           "re-included in subtree",
+		"web/other.log":          "ignored by parent rule",
+		"web/root.txt":           "kept, anchored rule of parent",
+		"web/.index.html.swp":    "ignored by .vaultignore",
+		"web/cache.tmp":          "ignored",
+		"other/cache.tmp":        "kept, rule only applies in web",
+		"other/build/nested.txt": "ignored directory at any level",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatalf("MkdirAll: %v\n", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+
+	g, err := NewGenerator(src, "./testdata/gen", WithSubdirsOption(true), IgnoreFilesOption(true))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	items, _, err := walkSrcDirectory(context.Background(), g.config)
+	if err != nil {
+		t.Fatalf("walkSrcDirectory: %v\n", err)
+	}
+
+	var got []string
+	for _, item := range items {
+		got = append(got, item.path)
+	}
+
+	want := []string{"/.gitignore", "/index.html", "/other/cache.tmp", "/web/.gitignore", "/web/keep.log", "/web/root.txt"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("walkSrcDirectory: get %v, want = %v\n", got, want)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	src, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(src)
+
+	files := map[string]string{
+		"index.html":     "index",
+		"shared/app.js":  "app",
+		"shared/app.css": "css",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatalf("MkdirAll: %v\n", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+
+	links := map[string]string{
+		"dist":        "shared",
+		"home.html":   "index.html",
+		"shared/loop": "..",
+		"broken.txt":  "missing.txt",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, filepath.FromSlash(name))); err != nil {
+			t.Skipf("Symlink: %v\n", err)
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		options []GeneratorOption
+		want    []string
+		aliases []string
+	}{
+		{"skip", nil, []string{"/index.html", "/shared/app.css", "/shared/app.js"}, nil},
+		{"follow", []GeneratorOption{FollowSymlinksOption(true)},
+			[]string{"/dist/app.css", "/dist/app.js", "/home.html", "/index.html", "/shared/app.css", "/shared/app.js"}, nil},
+		{"aliases", []GeneratorOption{SymlinkAliasesOption(true)},
+			[]string{"/dist/app.css", "/dist/app.js", "/home.html", "/index.html", "/shared/app.css", "/shared/app.js"},
+			[]string{"/dist/app.css=/shared/app.css", "/dist/app.js=/shared/app.js", "/home.html=/index.html"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := NewGenerator(src, "./testdata/gen", append(tc.options, WithSubdirsOption(true))...)
+			if err != nil {
+				t.Fatalf("NewGenerator: %v\n", err)
+			}
+
+			items, _, err := walkSrcDirectory(context.Background(), g.config)
+			if err != nil {
+				t.Fatalf("walkSrcDirectory: %v\n", err)
+			}
+
+			var got, aliases []string
+			for _, item := range items {
+				got = append(got, item.path)
+				if item.alias {
+					aliases = append(aliases, item.path+"="+items[item.target].path)
+				}
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("walkSrcDirectory: get %v, want = %v\n", got, tc.want)
+			}
+
+			if fmt.Sprint(aliases) != fmt.Sprint(tc.aliases) {
+				t.Errorf("aliases: get %v, want = %v\n", aliases, tc.aliases)
+			}
+		})
+	}
+
+	// The aliases /dist/app.css and /dist/app.js precede their targets
+	dest, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(dest)
+
+	g, err := NewGenerator(src, dest, SymlinkAliasesOption(true), WithSubdirsOption(true), ResourceNameOption("links"))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+	if err := g.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v\n", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "manifest_links_vault.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("Unmarshal: %v\n", err)
+	}
+
+	hashes := map[string]string{}
+	for _, e := range m.Files {
+		hashes[e.Path] = e.Hash
+	}
+	for alias, target := range map[string]string{"/dist/app.css": "/shared/app.css", "/dist/app.js": "/shared/app.js", "/home.html": "/index.html"} {
+		if hashes[alias] == "" || hashes[alias] != hashes[target] {
+			t.Errorf("alias %v: get hash %q, want = %q\n", alias, hashes[alias], hashes[target])
+		}
+	}
+}
+
+func TestReproducibleOutput(t *testing.T) {
+	var outputs [2][]string
+	for i, mtime := range []time.Time{time.Unix(1000, 0), time.Unix(2000, 0)} {
+		tmp, err := ioutil.TempDir("", "vault")
+		if err != nil {
+			t.Fatalf("TempDir: %v\n", err)
+		}
+		defer os.RemoveAll(tmp)
+
+		// Copy the assets, so each run sees other modification times
+		src := filepath.Join(tmp, "assets")
+		if err := os.MkdirAll(src, 0700); err != nil {
+			t.Fatalf("MkdirAll: %v\n", err)
+		}
+
+		fis, err := ioutil.ReadDir("./testdata/assets")
+		if err != nil {
+			t.Fatalf("ReadDir: %v\n", err)
+		}
+
+		for _, fi := range fis {
+			if fi.IsDir() {
+				continue
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join("./testdata/assets", fi.Name()))
+			if err != nil {
+				t.Fatalf("ReadFile: %v\n", err)
+			}
+
+			p := filepath.Join(src, fi.Name())
+			if err := ioutil.WriteFile(p, data, 0600); err != nil {
+				t.Fatalf("WriteFile: %v\n", err)
+			}
+
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				t.Fatalf("Chtimes: %v\n", err)
+			}
+		}
+
+		dest := filepath.Join(tmp, "gen")
+		g, err := NewGenerator(src, dest, RelativePathOption("./assets"), WorkersOption(i+1),
+			ModTimeOption(time.Unix(1500000000, 0)))
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		if err := g.Run(context.Background()); err != nil {
+			t.Fatalf("Run: %v\n", err)
+		}
+
+		// The manifest is compared too, it must not record the modification times of the sources
+		for _, f := range append(g.outputFiles(), g.manifestFile) {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatalf("ReadFile: %v\n", err)
+			}
+			outputs[i] = append(outputs[i], string(data))
+		}
+	}
+
+	for i := range outputs[0] {
+		if outputs[0][i] != outputs[1][i] {
+			t.Errorf("output file %v differs between runs\n", i)
+		}
+	}
+
+	if !strings.Contains(outputs[0][2], "modTime: 1500000000,") {
+		t.Errorf("release file does not contain the fixed modification time\n")
+	}
+}
+
+func TestSourceDateEpochOption(t *testing.T) {
+	defer os.Setenv("SOURCE_DATE_EPOCH", os.Getenv("SOURCE_DATE_EPOCH"))
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	g, err := NewGenerator("./testdata/assets", "./testdata/gen", SourceDateEpochOption(true))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	if !g.config.fixedModTime || g.config.modTime.Unix() != 1500000000 {
+		t.Errorf("SourceDateEpochOption: get %v, want = %v\n", g.config.modTime.Unix(), 1500000000)
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	_, err = NewGenerator("./testdata/assets", "./testdata/gen", SourceDateEpochOption(true))
+	var optErr *InvalidOptionError
+	if !errors.As(err, &optErr) {
+		t.Errorf("NewGenerator: get %v, want = InvalidOptionError\n", err)
+	}
+}
+
+func TestDataEncodings(t *testing.T) {
+	data := [][]byte{
+		[]byte("plain text\nwith\ttabs and \"quotes\" and \\ backslashes"),
+		{0x00, 0xff, 0x1f, 'a', '`'},
+		[]byte("raw `backtick`"),
+		[]byte("carriage\r\nreturn"),
+		[]byte("\ufeffbyte order mark"),
+		{},
+		[]byte("unicode ✓ text"),
+	}
+	want := string(bytes.Join(data, nil))
+
+	for i := range encodingNames {
+		enc := Encoding(i)
+		t.Run(enc.String(), func(t *testing.T) {
+			var buf, asm bytes.Buffer
+			e, err := newDataEncoder(enc, &buf, &asm, "Test")
+			if err != nil {
+				t.Fatalf("newDataEncoder: %v\n", err)
+			}
+
+			for _, d := range data {
+				if err := e.write(d); err != nil {
+					t.Fatalf("write: %v\n", err)
+				}
+			}
+
+			if err := e.close(); err != nil {
+				t.Fatalf("close: %v\n", err)
+			}
+
+			f, err := parser.ParseFile(token.NewFileSet(), "", "package test\n"+buf.String(), 0)
+			if err != nil {
+				t.Fatalf("ParseFile: %v\n%v", err, buf.String())
+			}
+
+			var got string
+			if enc == AssemblyEncoding {
+				if got, err = evalAsm(asm.String()); err != nil {
+					t.Fatalf("evalAsm: %v\n", err)
+				}
+			}
+
+			for _, decl := range f.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if enc == AssemblyEncoding || !ok || len(gd.Specs[0].(*ast.ValueSpec).Values) == 0 {
+					continue
+				}
+
+				if got, err = evalString(gd.Specs[0].(*ast.ValueSpec).Values[0]); err != nil {
+					t.Fatalf("evalString: %v\n", err)
+				}
+			}
+
+			if enc == Base64Encoding {
+				b, err := base64.StdEncoding.DecodeString(got)
+				if err != nil {
+					t.Fatalf("DecodeString: %v\n", err)
+				}
+				got = string(b)
+			}
+
+			if got != want {
+				t.Errorf("decoded data: get %q, want = %q\n", got, want)
+			}
+
+			// The reported size is computed without encoding the data
+			for _, data := range [][][]byte{data, nil} {
+				var w countWriter
+				e, _ := newDataEncoder(enc, &w, &w, "Test")
+				counter := &sizeCounter{assetName: "Test"}
+				for _, d := range data {
+					e.write(d)
+					counter.write(d)
+				}
+				e.close()
+
+				if size := counter.size(enc); size != w.n {
+					t.Errorf("size of %v files: get %v, want = %v\n", len(data), size, w.n)
+				}
+			}
+		})
+	}
+}
+
+// evalString evaluates a concatenation of string literals.
+func evalString(expr ast.Expr) (string, error) {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		return strconv.Unquote(e.Value)
+	case *ast.BinaryExpr:
+		x, err := evalString(e.X)
+		if err != nil {
+			return "", err
+		}
+
+		y, err := evalString(e.Y)
+		return x + y, err
+	}
+	return "", fmt.Errorf("unexpected expression %T", expr)
+}
+
+// evalAsm returns the data of the DATA directives and checks their offsets and sizes.
+func evalAsm(src string) (string, error) {
+	var data string
+	for _, line := range strings.Split(src, "\n") {
+		if !strings.HasPrefix(line, "DATA ") {
+			continue
+		}
+
+		var offset, size int
+		idx := strings.Index(line, "+")
+		if _, err := fmt.Sscanf(line[idx:], "+%d(SB)/%d,", &offset, &size); err != nil {
+			return "", err
+		}
+
+		s, err := strconv.Unquote(line[strings.Index(line, "$")+1:])
+		if err != nil {
+			return "", err
+		}
+
+		if offset != len(data) || size != len(s) {
+			return "", fmt.Errorf("invalid directive '%v'", line)
+		}
+		data += s
+	}
+
+	if !strings.Contains(src, fmt.Sprintf("$%d\n", len(data))) {
+		return "", errors.New("missing GLOBL directive")
+	}
+	return data, nil
+}
+
+func TestShardSizeOption(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src, dest := filepath.Join(tmp, "assets"), filepath.Join(tmp, "res")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v\n", err)
+	}
+
+	// Random data can not be compressed and splits over several shards
+	rnd := rand.New(rand.NewSource(1))
+	var want []byte
+	for _, name := range []string{"a.bin", "b.txt", "c.bin"} {
+		data := make([]byte, 100*1024)
+		rnd.Read(data)
+		if name == "b.txt" {
+			data = []byte("small file")
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(src, name), data, 0600); err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+		want = append(want, data...)
+	}
+
+	const size = 64 * 1024
+	g, err := NewGenerator(src, dest, CompressOption(false), ShardSizeOption(size))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	if err := g.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v\n", err)
+	}
+
+	shards, _ := filepath.Glob(filepath.Join(dest, "release_assets_vault_[0-9][0-9][0-9].go"))
+	if len(shards) < 2 {
+		t.Fatalf("Run: get %v shards, want > 1\n", len(shards))
+	}
+
+	var got string
+	for _, shard := range shards {
+		fi, err := os.Stat(shard)
+		if err != nil {
+			t.Fatalf("Stat: %v\n", err)
+		}
+
+		if fi.Size() > size {
+			t.Errorf("shard %v: get size %v, want <= %v\n", shard, fi.Size(), size)
+		}
+
+		f, err := parser.ParseFile(token.NewFileSet(), shard, nil, 0)
+		if err != nil {
+			t.Fatalf("ParseFile: %v\n", err)
+		}
+
+		data, err := evalString(f.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec).Values[0])
+		if err != nil {
+			t.Fatalf("evalString: %v\n", err)
+		}
+		got += data
+	}
+
+	if got != string(want) {
+		t.Errorf("shards do not contain the data of all files\n")
+	}
+
+	// Without sharding all shards of the previous run are removed, but not
+	// the release file of a vault named assets_vault_000
+	other := filepath.Join(dest, "release_assets_vault_000_vault.go")
+	if err := ioutil.WriteFile(other, []byte("package assets\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+
+	g, err = NewGenerator(src, dest, CompressOption(false))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	if err := g.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v\n", err)
+	}
+
+	if shards, _ := filepath.Glob(filepath.Join(dest, "release_assets_vault_[0-9][0-9][0-9].go")); len(shards) != 0 {
+		t.Errorf("Run: stale shards %v\n", shards)
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Run: release file of another vault removed: %v\n", err)
+	}
+
+	// A file ending with _386 is only built for GOARCH=386
+	for idx, want := range map[int]string{0: "_000.go", 385: "_385.go", 386: "_387.go", 1000: "_1001.go"} {
+		if name := g.shardFile(idx, ".go"); !strings.HasSuffix(name, "release_assets_vault"+want) {
+			t.Errorf("shardFile: get %v, want = release_assets_vault%v\n", name, want)
+		}
+	}
+
+	_, err = NewGenerator(src, dest, ShardSizeOption(1024))
+	var optErr *InvalidOptionError
+	if !errors.As(err, &optErr) {
+		t.Errorf("NewGenerator: get %v, want = InvalidOptionError\n", err)
+	}
+}
+
+func TestStreamLargeFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "assets")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v\n", err)
+	}
+
+	// A sparse file is created fast and compresses well
+	const size = 64 * 1024 * 1024
+	f, err := os.Create(filepath.Join(src, "large.bin"))
+	if err != nil {
+		t.Fatalf("Create: %v\n", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("Truncate: %v\n", err)
+	}
+	f.Close()
+
+	g, err := NewGenerator(src, filepath.Join(tmp, "res"), CompressionLevelOption(1))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	// Track the peak of the heap during the generation
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > max {
+				max = ms.HeapAlloc
+			}
+
+			select {
+			case <-done:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	err = g.Run(context.Background())
+	close(done)
+	if err != nil {
+		t.Fatalf("Run: %v\n", err)
+	}
+
+	if max := <-peak; max > size/4 {
+		t.Errorf("Run: heap peak %v bytes, want <= %v\n", max, size/4)
+	}
+
+	g, err = NewGenerator(src, filepath.Join(tmp, "res"), MaxFileSizeOption(size-1), ForceOption(true))
+	if err != nil {
+		t.Fatalf("NewGenerator: %v\n", err)
+	}
+
+	var sizeErr *FileTooLargeError
+	if err := g.Run(context.Background()); !errors.As(err, &sizeErr) {
+		t.Errorf("Run: get %v, want = FileTooLargeError\n", err)
+	}
+}
+
+// shardReadMain reads all files of the vault and compares them with the source directory.
+const shardReadMain = `package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"shards/res"
+)
+
+func main() {
+	loader := res.NewShardsLoader()
+	for _, name := range loader.Names() {
+		want, err := ioutil.ReadFile(filepath.Join(os.Args[1], filepath.FromSlash(name)))
+		if err != nil {
+			panic(err)
+		}
+
+		got, err := loader.ReadFile(name)
+		if err != nil || !bytes.Equal(got, want) {
+			fmt.Printf("ReadFile %v: content differs, error: %v\n", name, err)
+			os.Exit(1)
+		}
+
+		f, err := loader.Open(name)
+		if err != nil {
+			panic(err)
+		}
+		buf := make([]byte, 5000)
+		for off := 0; off < len(want); off += 3001 {
+			n, err := f.(io.ReaderAt).ReadAt(buf, int64(off))
+			if (err != nil && err != io.EOF) || !bytes.Equal(buf[:n], want[off:off+n]) || (n < len(buf) && off+n != len(want)) {
+				fmt.Printf("ReadAt %v at %v: content differs, error: %v\n", name, off, err)
+				os.Exit(1)
+			}
+		}
+		f.Close()
+	}
+	fmt.Print(len(loader.Names()))
+}
+`
+
+func TestReadShardedVault(t *testing.T) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go command not found: %v\n", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src, dest := filepath.Join(tmp, "assets"), filepath.Join(tmp, "res")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v\n", err)
+	}
+
+	// Hex text compresses to about half of its size, random data is stored,
+	// both are larger than a shard. The large file is streamed into the vault.
+	rnd := rand.New(rand.NewSource(1))
+	text := make([]byte, streamSize/2+1024)
+	rnd.Read(text)
+	files := map[string][]byte{
+		"text.txt":   []byte(fmt.Sprintf("%x", text[:150*1024])),
+		"random.bin": text[:100*1024],
+		"small.txt":  []byte("small file"),
+		"large.txt":  []byte(fmt.Sprintf("%x", text)),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, name), data, 0600); err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+
+	for name, content := range map[string]string{"go.mod": "module shards\n", "main.go": shardReadMain} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+
+	// The vaults without compressed files do not declare the decompressor pools
+	testCases := []struct {
+		desc   string
+		enc    Encoding
+		option GeneratorOption
+		blocks bool
+	}{
+		{desc: "Escaped", enc: EscapedEncoding, option: CodecOption(ZlibCodec), blocks: true},
+		{desc: "Assembly", enc: AssemblyEncoding, option: CodecOption(ZlibCodec), blocks: true},
+		{desc: "Stored", enc: EscapedEncoding, option: CompressOption(false)},
+		{desc: "LZW", enc: AssemblyEncoding, option: CodecOption(LZWCodec), blocks: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			os.RemoveAll(dest)
+			g, err := NewGenerator(src, dest, ResourceNameOption("shards"), EncodingOption(tc.enc), tc.option,
+				ShardSizeOption(minShardSize), BlockSizeOption(4096))
+			if err != nil {
+				t.Fatalf("NewGenerator: %v\n", err)
+			}
+
+			if err := g.Run(context.Background()); err != nil {
+				t.Fatalf("Run: %v\n", err)
+			}
+
+			if shards, _ := filepath.Glob(filepath.Join(dest, "release_shards_vault_[0-9]*.go")); len(shards) < 3 {
+				t.Fatalf("Run: get %v shards, want >= 3\n", len(shards))
+			}
+
+			release, err := ioutil.ReadFile(filepath.Join(dest, "release_shards_vault.go"))
+			if err != nil {
+				t.Fatalf("ReadFile: %v\n", err)
+			}
+			if strings.Contains(string(release), "blocks: []int64{") != tc.blocks || !strings.Contains(string(release), "codec: codecStoredShards") {
+				t.Fatalf("release file does not contain the expected compressed and stored files\n")
+			}
+
+			cmd := exec.Command(goBin, "run", ".", src)
+			cmd.Dir = tmp
+			if out, err := cmd.CombinedOutput(); err != nil || string(out) != "4" {
+				t.Errorf("go run: %v\n%s", err, out)
+			}
+		})
+	}
+}
+
+func TestMultipleVaultsInPackage(t *testing.T) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go command not found: %v\n", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "go.mod"), []byte("module multi\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+
+	dest := filepath.Join(tmp, "res")
+	for _, options := range [][]GeneratorOption{
+		{ResourceNameOption("first"), CodecOption(GzipCodec)},
+		{ResourceNameOption("second"), EncodingOption(Base64Encoding), WithSubdirsOption(true)},
+	} {
+		g, err := NewGenerator("./testdata/assets", dest, options...)
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		if err := g.Run(context.Background()); err != nil {
+			t.Fatalf("Run: %v\n", err)
+		}
+	}
+
+	for _, tags := range []string{"", "debug"} {
+		cmd := exec.Command(goBin, "vet", "-tags", tags, "./res")
+		cmd.Dir = tmp
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("go vet -tags '%v': %v\n%s", tags, err, out)
+		}
+	}
+}
+
+func TestBuildTagOption(t *testing.T) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go command not found: %v\n", err)
+	}
+
+	if _, err := NewGenerator("./testdata/assets", "./testdata/gen", BuildTagOption("dev &&")); !errors.As(err, new(*InvalidOptionError)) {
+		t.Errorf("BuildTagOption: want InvalidOptionError, got %v\n", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "go.mod"), []byte("module tags\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+
+	dest := filepath.Join(tmp, "res")
+	run := func(options ...GeneratorOption) {
+		g, err := NewGenerator("./testdata/assets", dest, append(options, ResourceNameOption("assets"))...)
+		if err != nil {
+			t.Fatalf("NewGenerator: %v\n", err)
+		}
+
+		if err := g.Run(context.Background()); err != nil {
+			t.Fatalf("Run: %v\n", err)
+		}
+	}
+
+	vet := func(tags ...string) {
+		for _, tag := range tags {
+			cmd := exec.Command(goBin, "vet", "-tags", tag, "./res")
+			cmd.Dir = tmp
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("go vet -tags '%v': %v\n%s", tag, err, out)
+			}
+		}
+	}
+
+	run(BuildTagOption("vaultdev || dev"), EncodingOption(AssemblyEncoding))
+	for file, want := range map[string]string{
+		"debug_assets_vault.go":   "//go:build vaultdev || dev\n// +build vaultdev dev\n\n",
+		"release_assets_vault.go": "//go:build !(vaultdev || dev)\n// +build !vaultdev,!dev\n\n",
+		"release_assets_vault.s":  "//go:build !(vaultdev || dev)\n// +build !vaultdev,!dev\n\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dest, file))
+		if err != nil {
+			t.Fatalf("ReadFile: %v\n", err)
+		}
+
+		if !strings.HasPrefix(string(data), want) {
+			t.Errorf("%v: want header %q, got %q\n", file, want, data[:len(want)])
+		}
+	}
+	vet("", "debug", "vaultdev", "dev")
+
+	run(DebugFileOption(false))
+	if _, err := os.Stat(filepath.Join(dest, "debug_assets_vault.go")); !os.IsNotExist(err) {
+		t.Errorf("DebugFileOption: debug file not removed: %v\n", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "release_assets_vault.go"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+
+	if bytes.Contains(data, []byte("//go:build")) || bytes.Contains(data, []byte("// +build")) {
+		t.Errorf("DebugFileOption: release file contains a build constraint\n")
+	}
+	vet("", "debug")
+}
+
+func BenchmarkFileServer(b *testing.B) {
+	handler := http.FileServer(gen.NewGenLoader())
+	for _, bc := range []struct {
+		name, path, rng string
+	}{
+		{"compressed", "/data/css.css", ""},
+		{"small", "/data/json/appsettings.json", ""},
+		{"stored", "/gopher.jpeg", ""},
+		{"range", "/data/css.css", "bytes=100000-100999"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, bc.path, nil)
+			if bc.rng != "" {
+				req.Header.Set("Range", bc.rng)
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK && rec.Code != http.StatusPartialContent {
+					b.Fatalf("ServeHTTP: status %v\n", rec.Code)
+				}
+			}
+		})
+	}
+}
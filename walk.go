@@ -0,0 +1,327 @@
+// Copyright © 2018 The Vault Authors
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// walkSrcDirectory walks all mounted source directories and returns the files
+// to process and the directories walked, both sorted by their path in the vault.
+func walkSrcDirectory(ctx context.Context, cfg GeneratorConfig) ([]fileItem, []dirItem, error) {
+	var items []fileItem
+	var dirs []dirItem
+	for _, m := range cfg.mounts {
+		w, err := walkMount(ctx, cfg, m)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, w.items...)
+		dirs = append(dirs, w.dirs...)
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].path < items[j].path })
+	// Directories mounted twice keep the metadata of the first mount
+	sort.SliceStable(dirs, func(i, j int) bool { return dirs[i].path < dirs[j].path })
+	if err := checkCollisions(cfg, items, dirs); err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.linkAliases {
+		markAliases(items)
+	}
+	return items, dirs, nil
+}
+
+// markAliases marks all items sharing the real path with another item as alias. The target
+// of the aliases is the item not reached through a symlink, the first item if all are.
+func markAliases(items []fileItem) {
+	targets := map[string]int{}
+	for i, item := range items {
+		if idx, ok := targets[item.realpath]; !ok || (items[idx].linked && !item.linked) {
+			targets[item.realpath] = i
+		}
+	}
+
+	for i := range items {
+		if idx := targets[items[i].realpath]; idx != i {
+			items[i].alias = true
+			items[i].target = idx
+		}
+	}
+}
+
+// Names of the ignore files read if the IgnoreFilesOption is set.
+const (
+	gitIgnoreFile   = ".gitignore"
+	vaultIgnoreFile = ".vaultignore"
+)
+
+// walker collects the files of a mounted directory.
+type walker struct {
+	ctx   context.Context
+	cfg   GeneratorConfig
+	m     mount
+	items []fileItem
+	// dirs contains the mounted directory and all subdirectories walked
+	dirs []dirItem
+	// parents contains the real paths of the directories currently walked
+	parents map[string]bool
+	// realSrc is the real path of the mounted directory, only set for SymlinkAliasesOption
+	realSrc string
+}
+
+// ignoreList contains the rules of an ignore file, the rules are
+// relative to the directory dir containing the ignore file.
+type ignoreList struct {
+	dir   string
+	rules []rule
+}
+
+// walkMount walks the mounted directory and returns the walker
+// containing all files to process and all directories walked.
+func walkMount(ctx context.Context, cfg GeneratorConfig, m mount) (*walker, error) {
+	fi, err := os.Stat(m.src)
+	if err != nil {
+		return nil, &WalkError{Path: m.src, Err: err}
+	}
+
+	if !fi.IsDir() {
+		return nil, &WalkError{Path: m.src, Err: errors.New("not a directory")}
+	}
+
+	w := &walker{ctx: ctx, cfg: cfg, m: m, parents: map[string]bool{}}
+	if cfg.linkAliases {
+		if w.realSrc, err = realPath(m.src); err != nil {
+			return nil, &WalkError{Path: m.src, Err: err}
+		}
+	}
+	if err := w.walkDir(m.src, "", fi, nil); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// follow reports whether symlinks are followed.
+func (w *walker) follow() bool {
+	return w.cfg.followLinks || w.cfg.linkAliases
+}
+
+// walkDir walks the directory dir, rel is the path of the directory relative
+// to the mounted directory and ignores the ignore lists of all parent directories.
+func (w *walker) walkDir(dir, rel string, fi os.FileInfo, ignores []ignoreList) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	if w.follow() {
+		real, err := realPath(dir)
+		if err != nil {
+			return &WalkError{Path: dir, Err: err}
+		}
+
+		if w.parents[real] {
+			log.Printf("skipping symlink loop '%v'...\n", dir)
+			return nil
+		}
+
+		w.parents[real] = true
+		defer delete(w.parents, real)
+	}
+	w.dirs = append(w.dirs, dirItem{path: path.Join(w.m.prefix, rel), fi: fi, fullpath: dir})
+
+	if w.cfg.ignoreFiles {
+		var err error
+		if ignores, err = readIgnoreFiles(dir, rel, ignores); err != nil {
+			return err
+		}
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return &WalkError{Path: dir, Err: err}
+	}
+
+	for _, fi := range fis {
+		p := path.Join(dir, fi.Name())
+		r := path.Join(rel, fi.Name())
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !w.follow() {
+				log.Printf("skipping symlink '%v'...\n", p)
+				continue
+			}
+
+			// Stat follows the symlink but keeps the name of the link
+			if fi, err = os.Stat(p); err != nil {
+				log.Printf("skipping broken symlink '%v': %v\n", p, err)
+				continue
+			}
+		}
+
+		if w.cfg.ignoreFiles && (fi.Name() == vaultIgnoreFile || ignored(ignores, r, fi.IsDir())) {
+			log.Printf("ignoring '%v'...\n", p)
+			continue
+		}
+
+		// Skip any directory if recursive is set to false (default)
+		if fi.IsDir() {
+			if !w.cfg.withSubdirs {
+				log.Printf("skipping directory '%v'...\n", p)
+				continue
+			}
+
+			if err := w.walkDir(p, r, fi, ignores); err != nil {
+				return err
+			}
+			continue
+		}
+
+		vaultPath := path.Join(w.m.prefix, r)
+		// If include is set, then only process matching files
+		var skip bool
+		if !w.cfg.inclM.empty() {
+			skip = !w.cfg.inclM.matches(vaultPath) || w.cfg.exclM.matches(vaultPath)
+		} else {
+			skip = w.cfg.exclM.matches(vaultPath)
+		}
+
+		if skip {
+			log.Printf("skipping file '%v'...\n", vaultPath)
+			continue
+		}
+
+		if w.cfg.maxFileSize > 0 && fi.Size() > w.cfg.maxFileSize {
+			return &FileTooLargeError{Path: p, Size: fi.Size(), Max: w.cfg.maxFileSize}
+		}
+
+		item := fileItem{path: vaultPath, fi: fi, fullpath: p}
+		if w.cfg.linkAliases {
+			if item.realpath, err = realPath(p); err != nil {
+				return &WalkError{Path: p, Err: err}
+			}
+			item.linked = item.realpath != filepath.Join(w.realSrc, filepath.FromSlash(r))
+		}
+		w.items = append(w.items, item)
+	}
+	return nil
+}
+
+// realPath returns the absolute path of p without any symlinks.
+func realPath(p string) (string, error) {
+	p, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(p)
+}
+
+// readIgnoreFiles appends the rules of the ignore files in dir to the ignore lists.
+// The returned slice is a copy, so the lists of the parent directories are not modified.
+func readIgnoreFiles(dir, rel string, ignores []ignoreList) ([]ignoreList, error) {
+	ignores = ignores[:len(ignores):len(ignores)]
+	for _, name := range []string{gitIgnoreFile, vaultIgnoreFile} {
+		file := path.Join(dir, name)
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, &WalkError{Path: file, Err: err}
+		}
+
+		list := ignoreList{dir: rel}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			r, ok, err := compileRule(GlobSyntax, line)
+			if err != nil {
+				return nil, &InvalidPatternError{Pattern: line, Err: fmt.Errorf("%v: %w", file, err)}
+			}
+
+			if ok {
+				list.rules = append(list.rules, r)
+			}
+		}
+		ignores = append(ignores, list)
+	}
+	return ignores, nil
+}
+
+// ignored reports whether the path rel (relative to the mounted directory)
+// is ignored. Like git, the last matching rule of the deepest ignore file wins.
+func ignored(ignores []ignoreList, rel string, isDir bool) bool {
+	var ign bool
+	for _, list := range ignores {
+		p := relPath(list.dir, rel)
+		for _, r := range list.rules {
+			if r.dirOnly && !isDir {
+				continue
+			}
+
+			if r.re.MatchString(p) {
+				ign = !r.negate
+			}
+		}
+	}
+	return ign
+}
+
+// relPath returns the slash separated path p relative to the directory base.
+func relPath(base, p string) string {
+	if base == "." {
+		return p
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(p, base), "/")
+}
+
+// checkCollisions returns a PathCollisionError if a path is used more than once
+// or if a file is placed at the path of a directory. The items must be sorted.
+// The walked directories are only checked if empty directories are included.
+func checkCollisions(cfg GeneratorConfig, items []fileItem, walked []dirItem) error {
+	dirs := map[string]string{}
+	for _, m := range cfg.mounts {
+		for d := m.prefix; d != "/"; d = path.Dir(d) {
+			if _, ok := dirs[d]; !ok {
+				dirs[d] = m.src
+			}
+		}
+	}
+
+	if cfg.emptyDirs {
+		for _, dir := range walked {
+			if _, ok := dirs[dir.path]; !ok && dir.path != "/" {
+				dirs[dir.path] = dir.fullpath
+			}
+		}
+	}
+
+	for i, item := range items {
+		if i > 0 && items[i-1].path == item.path {
+			return &PathCollisionError{Path: item.path, Sources: []string{items[i-1].fullpath, item.fullpath}}
+		}
+
+		for d := path.Dir(item.path); d != "/"; d = path.Dir(d) {
+			if _, ok := dirs[d]; !ok {
+				dirs[d] = item.fullpath
+			}
+		}
+	}
+
+	for _, item := range items {
+		if src, ok := dirs[item.path]; ok {
+			return &PathCollisionError{Path: item.path, Sources: []string{src, item.fullpath}}
+		}
+	}
+	return nil
+}